@@ -0,0 +1,239 @@
+package lib
+
+import (
+	"cmp"
+	"context"
+	"maps"
+	"math"
+	"slices"
+	"sync"
+)
+
+// The documentLine struct is the record of a Corpus: a line and the document
+// it belongs to.
+type documentLine struct {
+	document uint
+	line     string
+}
+
+// The DocumentCount struct is a count of a word in a document, returned by
+// Corpus.DocumentCounts. It is also the value emitted by the mapper of a
+// Corpus, with a "Count" of 1 for each occurrence.
+type DocumentCount struct {
+	Document uint
+	Count    uint
+}
+
+// The DocumentScore struct is the TF-IDF score of a word in a document,
+// returned by Corpus.TFIDF.
+type DocumentScore struct {
+	Document uint
+	Count    uint
+	Score    float64
+}
+
+// compareDocumentScores orders document scores by score in descending order,
+// then by document in ascending order.
+func compareDocumentScores(ds1, ds2 DocumentScore) int {
+	switch {
+	case ds1.Score > ds2.Score:
+		return -1
+	case ds1.Score < ds2.Score:
+		return 1
+	case ds1.Document < ds2.Document:
+		return -1
+	case ds1.Document > ds2.Document:
+		return 1
+	}
+	return 0
+}
+
+// countPerDocument is the Reducer of a Corpus. The accumulated value of a
+// word is its count in each document, so that the number of documents in the
+// map is the document frequency of the word. The map is modified in place,
+// so it is only read by the reducer goroutine keeping it (see Corpus.lookup).
+func countPerDocument(acc map[uint]uint, value DocumentCount) map[uint]uint {
+	if acc == nil {
+		acc = make(map[uint]uint)
+	}
+	acc[value.Document] += value.Count
+	return acc
+}
+
+// The Corpus struct is a running map-reduce network for counting words in
+// many documents, created by NewCorpus. Unlike Network, it keeps the count of
+// each word in each document, so that it answers the number of documents
+// containing a word (the document frequency), and ranks the documents by the
+// TF-IDF score of a word. Its methods could be called by many goroutines
+// concurrently. It must not be used after Close is called.
+//
+// Like the queries of Network, the queries of Corpus wait until every line
+// passed to Map before the call has been counted.
+type Corpus struct {
+	n         *network[documentLine, string, DocumentCount, map[uint]uint]
+	mutex     sync.Mutex
+	names     []string
+	lengths   []uint
+	closeOnce sync.Once
+}
+
+// NewCorpus sets-up all the channels and goroutines of a map-reduce network
+// for counting words in many documents. It accepts the same options as
+// NewNetwork, except WithCombiner, WithRemoteReducers and WithApproximation.
+// If NewCorpus succeeds, it returns the Corpus and a nil error;
+// Otherwise, it returns nil and a non-nil error.
+func NewCorpus(options ...Option) (*Corpus, error) {
+	c := newConfig(options)
+	corpus := &Corpus{}
+	countWords := CountNGrams(c.tokenizer, c.ngrams)
+	minSize, maxSize := c.ngrams.sizes()
+	mapper := func(lineNo uint, record documentLine, emit func(string, DocumentCount)) {
+		var words []string
+		countWords(lineNo, record.line, func(word string, count uint) {
+			words = append(words, word)
+		})
+		// The length is the number of words only. When n-grams are counted,
+		// the words are counted again, so that the n-grams are not.
+		length := uint(len(words))
+		if minSize != 1 || maxSize != 1 {
+			length = 0
+			c.tokenizer.Tokenize(record.line, func(token string, offset uint) {
+				length++
+			})
+		}
+		// The length is added before the words are emitted, so that a line
+		// of an unknown document is not counted at all.
+		corpus.addLength(record.document, length)
+		for _, word := range words {
+			emit(word, DocumentCount{record.document, 1})
+		}
+	}
+	n, err := newNetwork(mapper, countPerDocument, c)
+	if err != nil {
+		return nil, err
+	}
+	corpus.n = n
+	return corpus, nil
+}
+
+// addLength adds length to the number of words in a document. It panics if
+// the document is not added by AddDocument.
+func (c *Corpus) addLength(document, length uint) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lengths[document] += length
+}
+
+// AddDocument adds a document named "name" to the corpus, and returns the
+// document number to be passed to Map. The documents are numbered from 0 in
+// the order they are added.
+func (c *Corpus) AddDocument(name string) uint {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.names = append(c.names, name)
+	c.lengths = append(c.lengths, 0)
+	return uint(len(c.names) - 1)
+}
+
+// Documents returns the names of the documents, indexed by document number.
+func (c *Corpus) Documents() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return slices.Clone(c.names)
+}
+
+// Map sends a line of a document to one of the mappers in a round-robin
+// manner, where it is split into words to be counted. "document" is the
+// number returned by AddDocument, and "lineNo" is the line number of the line.
+// A line of an unknown document is reported as an error (see Err).
+func (c *Corpus) Map(document, lineNo uint, line string) {
+	c.n.mapFunc(lineNo, documentLine{document, line})
+}
+
+// MapContext is the same as Map, except that it returns the error of ctx if
+// ctx is done before a mapper receives the line. The line is then not counted.
+func (c *Corpus) MapContext(ctx context.Context, document, lineNo uint, line string) error {
+	return c.n.mapContext(ctx, lineNo, documentLine{document, line})
+}
+
+// lookup returns a copy of the counts of a word in each document. The
+// dictionary of the reducer keeping the word is visited, instead of queried,
+// since the counts are only read by that reducer goroutine. The other reducers
+// are not visited, and the visit is made once, so "counts" is written by one
+// goroutine only, before visitKey returns.
+func (c *Corpus) lookup(word string) map[uint]uint {
+	var counts map[uint]uint
+	c.n.visitKey(word, func(dictionary map[string]map[uint]uint) {
+		if perDocument, ok := dictionary[word]; ok {
+			counts = maps.Clone(perDocument)
+		}
+	})
+	return counts
+}
+
+// Query returns the count of a word in all documents.
+func (c *Corpus) Query(word string) uint {
+	total := uint(0)
+	for _, count := range c.lookup(word) {
+		total += count
+	}
+	return total
+}
+
+// DocumentCounts returns the counts of a word in the documents containing it,
+// ordered by document number.
+func (c *Corpus) DocumentCounts(word string) []DocumentCount {
+	var dcs []DocumentCount
+	for document, count := range c.lookup(word) {
+		dcs = append(dcs, DocumentCount{document, count})
+	}
+	slices.SortFunc(dcs, func(dc1, dc2 DocumentCount) int {
+		return cmp.Compare(dc1.Document, dc2.Document)
+	})
+	return dcs
+}
+
+// DocumentFrequency returns the number of documents containing a word.
+func (c *Corpus) DocumentFrequency(word string) uint {
+	return uint(len(c.lookup(word)))
+}
+
+// TFIDF returns the k documents with the largest TF-IDF scores of a word, in
+// descending order of score. Documents with the same score are ordered by
+// document number. The score of a word in a document is
+//
+//	tf * idf = (count / length) * (ln((1 + N) / (1 + df)) + 1)
+//
+// where "count" is the count of the word in the document, "length" is the
+// number of words in the document (not counting the n-grams, if they are
+// counted; see WithNGrams), "N" is the number of documents, and "df"
+// is the document frequency of the word. The idf is smoothed, so that a word
+// in every document still has a positive score.
+func (c *Corpus) TFIDF(word string, k uint) []DocumentScore {
+	counts := c.lookup(word)
+
+	c.mutex.Lock()
+	documentCount := float64(len(c.names))
+	idf := math.Log((1+documentCount)/(1+float64(len(counts)))) + 1
+	scores := make([]DocumentScore, 0, len(counts))
+	for document, count := range counts {
+		tf := float64(count) / float64(c.lengths[document])
+		scores = append(scores, DocumentScore{document, count, tf * idf})
+	}
+	c.mutex.Unlock()
+
+	slices.SortFunc(scores, compareDocumentScores)
+	return scores[:min(k, uint(len(scores)))]
+}
+
+// Err returns the first error reported by the stage goroutines, such as a
+// StageError for a line of an unknown document, or nil if there is none.
+func (c *Corpus) Err() error {
+	return c.n.errors.err()
+}
+
+// Close gracefully terminates the map-reduce network, after every line passed
+// to Map has been counted. Calling it more than once has no effect.
+func (c *Corpus) Close() {
+	c.closeOnce.Do(c.n.shutdown)
+}
@@ -0,0 +1,123 @@
+package lib
+
+import (
+	"math"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+///////////
+// Tests //
+///////////
+
+// TestCorpus checks the per-document counts, the document frequencies and the
+// TF-IDF scores of a corpus of three documents.
+func TestCorpus(t *testing.T) {
+	corpus := newTestStages(t, NewCorpus, 3, 2, 4)
+	defer corpus.Close()
+	documents := map[string][]string{
+		"a.txt": {"TCP three-way handshake", "TCP SYN"},
+		"b.txt": {"UDP datagram", "UDP TCP"},
+		"c.txt": {"UDP UDP UDP"},
+	}
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		document := corpus.AddDocument(name)
+		for lineNo, line := range documents[name] {
+			corpus.Map(document, uint(lineNo), line)
+		}
+	}
+
+	if got := corpus.Documents(); !reflect.DeepEqual(got, []string{"a.txt", "b.txt", "c.txt"}) {
+		t.Errorf("Documents() = %v", got)
+	}
+	if got := corpus.Query("UDP"); got != 5 {
+		t.Errorf("Query(%q) = %d, expected 5", "UDP", got)
+	}
+	expected := []DocumentCount{{0, 2}, {1, 1}}
+	if got := corpus.DocumentCounts("TCP"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("DocumentCounts(%q) = %v, expected %v", "TCP", got, expected)
+	}
+	for word, df := range map[string]uint{"TCP": 2, "UDP": 2, "SYN": 1, "ICMP": 0} {
+		if got := corpus.DocumentFrequency(word); got != df {
+			t.Errorf("DocumentFrequency(%q) = %d, expected %d", word, got, df)
+		}
+	}
+
+	// The lengths of a.txt, b.txt and c.txt are 5, 4 and 3 words.
+	idf := math.Log(4.0/3.0) + 1
+	scores := corpus.TFIDF("UDP", 5)
+	if len(scores) != 2 || scores[0].Document != 2 || scores[1].Document != 1 {
+		t.Fatalf("TFIDF(%q, 5) = %v, expected documents 2 and 1", "UDP", scores)
+	}
+	for i, tf := range []float64{3.0 / 3.0, 2.0 / 4.0} {
+		if math.Abs(scores[i].Score-tf*idf) > 1e-9 {
+			t.Errorf("TFIDF(%q, 5)[%d].Score = %v, expected %v", "UDP", i, scores[i].Score, tf*idf)
+		}
+	}
+	if got := corpus.TFIDF("UDP", 1); len(got) != 1 || got[0].Count != 3 {
+		t.Errorf("TFIDF(%q, 1) = %v, expected document 2 only", "UDP", got)
+	}
+	if got := corpus.TFIDF("ICMP", 5); len(got) != 0 {
+		t.Errorf("TFIDF(%q, 5) = %v, expected none", "ICMP", got)
+	}
+
+	if err := corpus.Err(); err != nil {
+		t.Errorf("Err() = %v", err)
+	}
+	corpus.Map(9, 0, "unknown document")
+	if got := corpus.Query("unknown"); got != 0 {
+		t.Errorf("Query(%q) = %d, expected 0", "unknown", got)
+	}
+	if err := corpus.Err(); err == nil {
+		t.Errorf("Err() = nil after a line of an unknown document")
+	}
+}
+
+// TestCorpusNGrams checks that the length of a document, used by the TF-IDF
+// scores, counts the words only when n-grams are counted.
+func TestCorpusNGrams(t *testing.T) {
+	cases := []struct {
+		ngrams NGrams
+		word   string
+		score  float64
+	}{
+		// "a.txt" has 3 words, and the idf of a word in both documents is 1.
+		{NGrams{}, "TCP", 1.0 / 3.0},
+		{NGrams{Min: 1, Max: 2}, "TCP", 1.0 / 3.0},
+		{NGrams{Min: 1, Max: 3, Skip: 1}, "TCP", 1.0 / 3.0},
+		// A bigram only in "a.txt" has an idf of ln(3/2) + 1.
+		{NGrams{Min: 2, Max: 2}, JoinNGram("TCP", "SYN"), (math.Log(3.0/2.0) + 1) / 3.0},
+	}
+	for _, c := range cases {
+		corpus := newTestStages(t, NewCorpus, 2, 2, 3, WithNGrams(c.ngrams))
+		corpus.Map(corpus.AddDocument("a.txt"), 0, "TCP SYN ACK")
+		corpus.Map(corpus.AddDocument("b.txt"), 0, "UDP TCP")
+		scores := corpus.TFIDF(c.word, 5)
+		i := slices.IndexFunc(scores, func(score DocumentScore) bool {
+			return score.Document == 0
+		})
+		if i < 0 || math.Abs(scores[i].Score-c.score) > 1e-9 {
+			t.Errorf("%+v: TFIDF(%q, 5) = %v, expected document 0 with score %v", c.ngrams, c.word, scores, c.score)
+		}
+		corpus.Close()
+	}
+}
+
+// TestNewCorpusErrors checks that NewCorpus() returns an error for the options
+// it does not support.
+func TestNewCorpusErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		options []Option
+	}{
+		{"a combiner", []Option{WithCombiner(Sum[uint], 1)}},
+		{"remote reducers", []Option{WithRemoteReducers("localhost:1")}},
+		{"approximation", []Option{WithApproximation(0.01, 0.01, 0.01)}},
+	}
+	for _, c := range cases {
+		if _, err := NewCorpus(c.options...); err == nil {
+			t.Errorf("NewCorpus() with %s returned a nil error", c.name)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package lib
+
+import (
+	"fmt"
+	"sync"
+)
+
+// The StageError struct is the error reported when a stage of a map-reduce
+// network fails to handle a message, usually because the Mapper, Partitioner
+// or Reducer panics. The message is skipped, and the network goes on.
+// "Stage" is the stage which fails: "mapper", "partitioner" or "reducer".
+// "Input" describes the input being handled, such as the line number or key.
+// "Value" is the value passed to panic, or the reason of the failure.
+type StageError struct {
+	Stage string
+	Input string
+	Value any
+}
+
+// Error returns the description of the error.
+func (e *StageError) Error() string {
+	return fmt.Sprintf("The %s failed on %s: %v", e.Stage, e.Input, e.Value)
+}
+
+// The DrainError struct is the error returned when a map-reduce network could
+// not be shut down before its context is done, because the goroutines of a
+// stage do not terminate. They are usually blocked by a Mapper, Partitioner or
+// Reducer which does not return, or by a stage after them.
+// "Stage" is the stage which fails to drain: "mapper", "partitioner" or
+// "reducer".
+// "Running" is the number of the goroutines of the stage still running.
+// "Err" is the error of the context.
+type DrainError struct {
+	Stage   string
+	Running int
+	Err     error
+}
+
+// Error returns the description of the error.
+func (e *DrainError) Error() string {
+	return fmt.Sprintf("The %s stage did not drain, with %d goroutines still running: %v", e.Stage, e.Running, e.Err)
+}
+
+// Unwrap returns the error of the context, so that errors.Is could tell
+// whether it is context.DeadlineExceeded or context.Canceled.
+func (e *DrainError) Unwrap() error {
+	return e.Err
+}
+
+// The errorLog struct keeps the errors reported by the stage goroutines of a
+// network. Only the first error is kept, but every error is counted in
+// "count", and passed to "handler" if it is not nil.
+type errorLog struct {
+	mutex   sync.Mutex
+	first   error
+	count   uint64
+	handler func(error)
+}
+
+// report records an error. It is called by the stage goroutines concurrently.
+func (l *errorLog) report(err error) {
+	l.mutex.Lock()
+	if l.first == nil {
+		l.first = err
+	}
+	l.count++
+	l.mutex.Unlock()
+	if l.handler != nil {
+		l.handler(err)
+	}
+}
+
+// err returns the first error reported, or nil if there is none.
+func (l *errorLog) err() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.first
+}
+
+// errorCount returns the number of errors reported.
+func (l *errorLog) errorCount() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.count
+}
+
+// protect calls f, and recovers the panic if f panics, so that a bad record
+// or key does not crash the whole process. The panic is reported as a
+// StageError of "stage" on "input". It returns whether f returns normally.
+func protect(stage string, input func() string, report func(error), f func()) (ok bool) {
+	defer func() {
+		if !ok {
+			report(&StageError{Stage: stage, Input: input(), Value: recover()})
+		}
+	}()
+	f()
+	return true
+}
+
+// lineInput, keyInput and visitInput describe the input of a stage for a
+// StageError. They are called only when an error is reported.
+func lineInput(lineNo uint) func() string {
+	return func() string { return fmt.Sprintf("line %d", lineNo) }
+}
+
+func keyInput[K comparable](key K) func() string {
+	return func() string { return fmt.Sprintf("key %q", keyString(key)) }
+}
+
+func visitInput() string {
+	return "a visit"
+}
+
+// validate checks the config of a network, including the stage counts, before
+// any goroutine is started. It returns a non-nil error describing the first
+// problem found.
+func (c config) validate() error {
+	if c.mapperCount == 0 {
+		return fmt.Errorf("The mapper count must be positive")
+	}
+	if c.partitionerCount == 0 {
+		return fmt.Errorf("The partitioner count must be positive")
+	}
+	if c.reducerCount == 0 && len(c.remoteReducers) == 0 {
+		return fmt.Errorf("The reducer count must be positive")
+	}
+	if c.partitioner == nil {
+		return fmt.Errorf("The partitioner must not be nil")
+	}
+	if err := c.ngrams.validate(); err != nil {
+		return err
+	}
+	if c.approximation != nil {
+		if len(c.remoteReducers) > 0 {
+			return fmt.Errorf("Remote reducers could not count approximately")
+		}
+		if err := c.approximation.validate(); err != nil {
+			return err
+		}
+	}
+	if c.spill != nil {
+		if len(c.remoteReducers) > 0 || c.approximation != nil {
+			return fmt.Errorf("Only the reducers counting exactly in this process could spill to disk")
+		}
+		if c.spill.budget == 0 {
+			return fmt.Errorf("The memory budget of a reducer must be positive")
+		}
+	}
+	for _, address := range c.remoteReducers {
+		if address == "" {
+			return fmt.Errorf("The address of a remote reducer must not be empty")
+		}
+	}
+	return nil
+}
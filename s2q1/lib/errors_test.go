@@ -0,0 +1,168 @@
+package lib
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+///////////
+// Tests //
+///////////
+
+// TestNewNetworkErrors checks that NewNetwork() returns an error, instead of a
+// network which panics or blocks, for invalid settings.
+func TestNewNetworkErrors(t *testing.T) {
+	// An address with nothing listening on it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() = %v", err)
+	}
+	closedAddress := listener.Addr().String()
+	listener.Close()
+
+	cases := []struct {
+		name                                        string
+		mapperCount, partitionerCount, reducerCount uint
+		options                                     []Option
+	}{
+		{"no mappers", 0, 1, 1, nil},
+		{"no partitioners", 1, 0, 1, nil},
+		{"no reducers", 1, 1, 0, nil},
+		{"nil partitioner", 1, 1, 1, []Option{WithPartitioner(nil)}},
+		{"combiner of another type", 1, 1, 1, []Option{WithCombiner(Sum[int], 1)}},
+		{"empty remote address", 1, 1, 0, []Option{WithRemoteReducers("")}},
+		{"unreachable remote reducer", 1, 1, 0, []Option{WithRemoteReducers(closedAddress)}},
+		{"approximation with a zero bound", 1, 1, 1, []Option{WithApproximation(0, 0.01, 0.01)}},
+		{"approximation with a bound of 1", 1, 1, 1, []Option{WithApproximation(0.01, 1, 0.01)}},
+		{"n-grams with Max less than Min", 1, 1, 1, []Option{WithNGrams(NGrams{Min: 3, Max: 2})}},
+		{"spill with no budget", 1, 1, 1, []Option{WithSpill(0, "")}},
+		{"approximate reducers spilling", 1, 1, 1, []Option{WithApproximation(0.01, 0.01, 0.01), WithSpill(1000, "")}},
+		{"approximate remote reducers", 1, 1, 0, []Option{WithApproximation(0.01, 0.01, 0.01), WithRemoteReducers("localhost:1")}},
+	}
+	for _, c := range cases {
+		options := append(c.options, WithMappers(c.mapperCount), WithPartitioners(c.partitionerCount), WithReducers(c.reducerCount))
+		if _, err := NewNetwork(options...); err == nil {
+			t.Errorf("NewNetwork() with %s returned a nil error", c.name)
+		}
+	}
+}
+
+// TestSetupPanics checks that Setup() panics with the error for invalid
+// settings, since it could not return it.
+func TestSetupPanics(t *testing.T) {
+	defer func() {
+		if _, ok := recover().(error); !ok {
+			t.Errorf("Setup(0, 1, 1) did not panic with an error")
+		}
+	}()
+	Setup(0, 1, 1)
+}
+
+// TestRecoverPanics checks that a Mapper, Partitioner or Reducer which panics
+// does not stop the network, and that the panics are reported as errors.
+func TestRecoverPanics(t *testing.T) {
+	var mutex sync.Mutex
+	var stages []string
+	handler := func(err error) {
+		var stageError *StageError
+		if !errors.As(err, &stageError) {
+			t.Errorf("reported %v, expected a StageError", err)
+			return
+		}
+		mutex.Lock()
+		stages = append(stages, stageError.Stage)
+		mutex.Unlock()
+	}
+
+	mapper := func(lineNo uint, line string, emit func(string, int)) {
+		for _, word := range strings.Fields(line) {
+			if word == "bad" {
+				panic("bad record")
+			}
+			emit(word, 1)
+		}
+	}
+	reducer := func(acc, value int) int {
+		if acc == 2 {
+			panic("too many")
+		}
+		return acc + value
+	}
+	partitioner := PartitionerFunc(func(key string, reducerCount int) int {
+		switch key {
+		case "boom":
+			panic("bad key")
+		case "far":
+			return reducerCount
+		}
+		return FNVPartitioner{}.Partition(key, reducerCount)
+	})
+	mapFunc, query, queryAll, shutdown := SetupMapReduce(2, 2, 2, mapper, reducer,
+		WithPartitioner(partitioner), WithErrorHandler(handler))
+	defer shutdown()
+
+	lines := []string{"a b", "a bad c", "boom a", "far d", "a"}
+	for lineNo, line := range lines {
+		mapFunc(uint(lineNo), line)
+	}
+	expected := map[string]int{"a": 2, "b": 1, "d": 1}
+	for key, count := range expected {
+		if got := query(key); got != count {
+			t.Errorf("query(%q) = %d, expected %d", key, got, count)
+		}
+	}
+	// Queries routed by a failing Partitioner are answered with the zero value.
+	for _, key := range []string{"boom", "far"} {
+		if got := query(key); got != 0 {
+			t.Errorf("query(%q) = %d, expected 0", key, got)
+		}
+	}
+	if got := len(queryAll()); got != 3 {
+		t.Errorf("queryAll() has %d keys, expected 3", got)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	counts := make(map[string]int)
+	for _, stage := range stages {
+		counts[stage]++
+	}
+	// mapper: "bad"; partitioner: "boom" and "far" mapped, then queried;
+	// reducer: the third and the fourth "a"
+	if counts["mapper"] != 1 || counts["partitioner"] != 4 || counts["reducer"] != 2 {
+		t.Errorf("reported errors of stages %v", stages)
+	}
+}
+
+// TestErr checks that Network.Err() returns the first error reported, and
+// that the errors are counted in Network.Stats().
+func TestErr(t *testing.T) {
+	partitioner := PartitionerFunc(func(key string, reducerCount int) int {
+		if key == "boom" {
+			panic("bad key")
+		}
+		return 0
+	})
+	network := newTestNetwork(t, 1, 1, 1, WithPartitioner(partitioner))
+	defer network.Close()
+
+	network.Map(0, "TCP")
+	if err := network.Err(); err != nil {
+		t.Errorf("Err() = %v, expected nil", err)
+	}
+	network.Map(1, "boom TCP")
+	if got := network.Query("TCP"); got != 2 {
+		t.Errorf("Query(%q) = %d, expected 2", "TCP", got)
+	}
+	err := network.Err()
+	var stageError *StageError
+	if !errors.As(err, &stageError) || stageError.Stage != "partitioner" || stageError.Input != `key "boom"` {
+		t.Errorf("Err() = %v, expected the error of the partitioner on %q", err, "boom")
+	}
+	if got := network.Stats().Errors; got != 1 {
+		t.Errorf("Stats().Errors = %d, expected 1", got)
+	}
+}
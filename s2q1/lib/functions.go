@@ -0,0 +1,263 @@
+package lib
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"iter"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// The WordCount struct is a word and its count, returned by the queries which
+// return more than one word. It is written as {"word": ..., "count": ...} in
+// JSON.
+type WordCount struct {
+	Word  string `json:"word"`
+	Count uint   `json:"count"`
+}
+
+// compareWordCounts orders word counts by count in descending order, then by
+// word in ascending order.
+func compareWordCounts(wc1, wc2 WordCount) int {
+	switch {
+	case wc1.Count > wc2.Count:
+		return -1
+	case wc1.Count < wc2.Count:
+		return 1
+	}
+	return strings.Compare(wc1.Word, wc2.Word)
+}
+
+// compareWords orders word counts by word in ascending order.
+func compareWords(wc1, wc2 WordCount) int {
+	return strings.Compare(wc1.Word, wc2.Word)
+}
+
+// The wordCountHeap type is a min-heap of word counts, ordered by
+// compareWordCounts, so that the root is the word count to be dropped first
+// when the k largest ones are kept.
+type wordCountHeap []WordCount
+
+func (h wordCountHeap) Len() int           { return len(h) }
+func (h wordCountHeap) Less(i, j int) bool { return compareWordCounts(h[i], h[j]) > 0 }
+func (h wordCountHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *wordCountHeap) Push(x any)        { *h = append(*h, x.(WordCount)) }
+func (h *wordCountHeap) Pop() any {
+	old := *h
+	wc := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return wc
+}
+
+// topK returns the k words with the largest counts in a sequence of words and
+// their counts, ordered by compareWordCounts. If size is not 0, only the
+// n-grams of size words are considered. It takes O(n log k) time and O(k)
+// extra space.
+func topK(words iter.Seq2[string, uint], k, size uint) []WordCount {
+	if k == 0 {
+		return nil
+	}
+	var h wordCountHeap
+	for word, count := range words {
+		if size != 0 && ngramSize(word) != size {
+			continue
+		}
+		wc := WordCount{word, count}
+		if uint(len(h)) < k {
+			heap.Push(&h, wc)
+		} else if compareWordCounts(wc, h[0]) < 0 {
+			h[0] = wc
+			heap.Fix(&h, 0)
+		}
+	}
+	slices.SortFunc(h, compareWordCounts)
+	return h
+}
+
+// SortWordCounts returns the words of a dictionary and their counts, ordered
+// by word, or by count in descending order (then by word) if byCount is true,
+// so that the order is the same every time. If k is not 0, only the k words
+// with the largest counts are returned, in the same order.
+func SortWordCounts(dictionary map[string]uint, byCount bool, k uint) []WordCount {
+	var wcs []WordCount
+	if k == 0 {
+		wcs = make([]WordCount, 0, len(dictionary))
+		for word, count := range dictionary {
+			wcs = append(wcs, WordCount{word, count})
+		}
+		slices.SortFunc(wcs, compareWordCounts)
+	} else {
+		wcs = topK(maps.All(dictionary), k, 0)
+	}
+	if !byCount {
+		slices.SortFunc(wcs, compareWords)
+	}
+	return wcs
+}
+
+// withPrefix returns the words in a sequence which start with prefix,
+// ordered by word.
+func withPrefix(words iter.Seq2[string, uint], prefix string) []WordCount {
+	var wcs []WordCount
+	for word, count := range words {
+		if strings.HasPrefix(word, prefix) {
+			wcs = append(wcs, WordCount{word, count})
+		}
+	}
+	slices.SortFunc(wcs, compareWords)
+	return wcs
+}
+
+// inCountRange returns the words in a sequence whose count is in [a, b],
+// ordered by word.
+func inCountRange(words iter.Seq2[string, uint], a, b uint) []WordCount {
+	var wcs []WordCount
+	for word, count := range words {
+		if a <= count && count <= b {
+			wcs = append(wcs, WordCount{word, count})
+		}
+	}
+	slices.SortFunc(wcs, compareWords)
+	return wcs
+}
+
+// The kinds of WordFilter.
+const (
+	filterAll        = ""
+	filterTopK       = "topk"
+	filterPrefix     = "prefix"
+	filterCountRange = "range"
+)
+
+// The WordFilter struct describes the partial answer of a query, which is
+// computed by a reducer from its local dictionary. It is a plain struct,
+// instead of a function, so that it could be sent to a reducer running in
+// another process (see remote.go).
+// "Kind" is the kind of the filter:
+// (1) If "Kind" is "" (filterAll), all words are selected;
+// (2) If "Kind" is "topk" (filterTopK), the "K" words with the largest counts
+//     are selected, among the n-grams of "Size" words if "Size" is not 0;
+// (3) If "Kind" is "prefix" (filterPrefix), the words starting with "Prefix"
+//     are selected;
+// (4) If "Kind" is "range" (filterCountRange), the words whose count is in
+//     ["Min", "Max"] are selected.
+type WordFilter struct {
+	Kind   string
+	K      uint
+	Size   uint
+	Prefix string
+	Min    uint
+	Max    uint
+}
+
+// apply returns the words selected by the filter from a sequence of words
+// and their counts, such as maps.All of a dictionary. Only the words selected
+// are kept in memory, so the sequence could be larger than memory (see
+// spillReducerRoutine).
+func (f WordFilter) apply(words iter.Seq2[string, uint]) []WordCount {
+	switch f.Kind {
+	case filterAll:
+		var wcs []WordCount
+		for word, count := range words {
+			wcs = append(wcs, WordCount{word, count})
+		}
+		return wcs
+	case filterTopK:
+		return topK(words, f.K, f.Size)
+	case filterPrefix:
+		return withPrefix(words, f.Prefix)
+	case filterCountRange:
+		return inCountRange(words, f.Min, f.Max)
+	}
+	panic(fmt.Sprintf("Unknown filter: %q", f.Kind))
+}
+
+// gather applies filter once in every reducer goroutine of the network, and
+// returns the partial results concatenated.
+func gather[R any, V any](n *network[R, string, V, uint], filter WordFilter) []WordCount {
+	var mutex sync.Mutex
+	var wcs []WordCount
+	n.visitAll(func(dictionary map[string]uint) {
+		p := filter.apply(maps.All(dictionary))
+		mutex.Lock()
+		wcs = append(wcs, p...)
+		mutex.Unlock()
+	}, filter)
+	return wcs
+}
+
+// The Functions struct contains the functions created by SetupFunctions to
+// interact with a map-reduce network which counts words.
+// "Map" is the "map" function which accepts a key (line number) and a value
+// (line).
+// "Query" accepts a keyword and returns its count.
+// "QueryAll" returns the whole dictionary by gathering the local dictionaries
+// from all reducers.
+// "TopK" returns the k words with the largest counts, in descending order of
+// count. Words with the same count are ordered by word.
+// "Prefix" returns the words starting with a prefix, ordered by word.
+// "CountRange" returns the words whose count is in [a, b], ordered by word.
+// "ScaleReducers" changes the number of reducers, moving the words to their
+// new reducers. Mapping and queries may go on while it runs, and the counts
+// are not affected. It returns a non-nil error if the number is 0.
+// "ReducerCount" returns the current number of reducers.
+// "Snapshot" writes the dictionaries of all reducers to a writer, in a
+// versioned JSON format.
+// "Restore" reads a snapshot written by "Snapshot" from a reader, and adds the
+// counts in it to the network. The network may have a different number of
+// reducers from the one the snapshot is taken, and may already have counts,
+// which are merged with the snapshot.
+// "Err" returns the first error reported by the stage goroutines, such as a
+// StageError when the Partitioner panics, or nil if there is none. The
+// message causing an error is skipped, and the network goes on.
+// "Shutdown" should be called to gracefully terminate the map-reduce network.
+//
+// "TopK", "Prefix" and "CountRange" are answered by each reducer with its
+// local dictionary, and only the partial answers are merged, so the whole
+// dictionary is never gathered.
+type Functions struct {
+	Map           func(uint, string)
+	Query         func(string) uint
+	QueryAll      func() map[string]uint
+	TopK          func(uint) []WordCount
+	Prefix        func(string) []WordCount
+	CountRange    func(uint, uint) []WordCount
+	ScaleReducers func(uint) error
+	ReducerCount  func() uint
+	Snapshot      func(io.Writer) error
+	Restore       func(io.Reader) error
+	Err           func() error
+	Shutdown      func()
+}
+
+// SetupFunctions sets-up the map-reduce network for counting words, like
+// Setup, and returns all the functions to interact with it.
+// It is kept for compatibility: SetupFunctions is a thin wrapper of
+// NewNetwork, whose methods the functions are.
+// If SetupFunctions succeeds, it returns the functions and a nil error;
+// Otherwise (for example, if any count is 0, or the remote reducers could not
+// be connected), it returns zero Functions and a non-nil error.
+func SetupFunctions(mapperCount, partitionerCount, reducerCount uint, options ...Option) (Functions, error) {
+	options = append(options[:len(options):len(options)], withStageCounts(mapperCount, partitionerCount, reducerCount))
+	network, err := NewNetwork(options...)
+	if err != nil {
+		return Functions{}, err
+	}
+	return Functions{
+		Map:           network.Map,
+		Query:         network.Query,
+		QueryAll:      network.QueryAll,
+		TopK:          network.TopK,
+		Prefix:        network.Prefix,
+		CountRange:    network.CountRange,
+		ScaleReducers: network.ScaleReducers,
+		ReducerCount:  network.n.reducerCount,
+		Snapshot:      network.Snapshot,
+		Restore:       network.Restore,
+		Err:           network.Err,
+		Shutdown:      network.Close,
+	}, nil
+}
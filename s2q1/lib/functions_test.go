@@ -0,0 +1,119 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+///////////
+// Tests //
+///////////
+
+// equalWordCounts returns whether two slices of word counts are equal,
+// treating a nil slice the same as an empty slice.
+func equalWordCounts(wcs1, wcs2 []WordCount) bool {
+	return len(wcs1) == 0 && len(wcs2) == 0 || reflect.DeepEqual(wcs1, wcs2)
+}
+
+// TestTopK checks the function topK() with predefined test cases.
+func TestTopK(t *testing.T) {
+	dictionary := map[string]uint{"a": 3, "b": 5, "c": 3, "d": 1, "e": 5, "b e": 4, "a b c": 6}
+	cases := []struct {
+		k, size  uint
+		expected []WordCount
+	}{
+		{0, 1, nil},
+		{1, 1, []WordCount{{"b", 5}}},
+		{3, 1, []WordCount{{"b", 5}, {"e", 5}, {"a", 3}}},
+		{5, 1, []WordCount{{"b", 5}, {"e", 5}, {"a", 3}, {"c", 3}, {"d", 1}}},
+		{9, 1, []WordCount{{"b", 5}, {"e", 5}, {"a", 3}, {"c", 3}, {"d", 1}}},
+		{3, 0, []WordCount{{"a b c", 6}, {"b", 5}, {"e", 5}}},
+		{3, 2, []WordCount{{"b e", 4}}},
+		{3, 4, nil},
+	}
+	for _, c := range cases {
+		if got := topK(maps.All(dictionary), c.k, c.size); !equalWordCounts(got, c.expected) {
+			t.Errorf("topK(%v, %d, %d) = %v, expected %v", dictionary, c.k, c.size, got, c.expected)
+		}
+	}
+}
+
+// TestSetupFunctions checks the queries returned by SetupFunctions() against
+// the answers computed from the whole dictionary.
+func TestSetupFunctions(t *testing.T) {
+	if _, err := SetupFunctions(1, 0, 1); err == nil {
+		t.Errorf("SetupFunctions(1, 0, 1) returned a nil error")
+	}
+	f, err := SetupFunctions(3, 2, 4)
+	if err != nil {
+		t.Fatalf("SetupFunctions(3, 2, 4) returned %v", err)
+	}
+	defer f.Shutdown()
+	for lineNo := uint(0); lineNo < 300; lineNo++ {
+		f.Map(lineNo, fmt.Sprintf("w%d w%d x%d TCP", lineNo%13, lineNo%5, lineNo%2))
+	}
+	dictionary := f.QueryAll()
+
+	var all []WordCount
+	for word, count := range dictionary {
+		all = append(all, WordCount{word, count})
+	}
+	slices.SortFunc(all, compareWordCounts)
+	for _, k := range []uint{0, 1, 4, 10, 100} {
+		if got, expected := f.TopK(k), all[:min(k, uint(len(all)))]; !equalWordCounts(got, expected) {
+			t.Errorf("TopK(%d) = %v, expected %v", k, got, expected)
+		}
+	}
+	if got := f.Prefix("x"); !equalWordCounts(got, []WordCount{{"x0", 150}, {"x1", 150}}) {
+		t.Errorf("Prefix(%q) = %v", "x", got)
+	}
+	if got := f.CountRange(300, 300); !equalWordCounts(got, []WordCount{{"TCP", 300}}) {
+		t.Errorf("CountRange(300, 300) = %v", got)
+	}
+
+	if err := f.ScaleReducers(2); err != nil || f.ReducerCount() != 2 {
+		t.Errorf("ScaleReducers(2) = %v, ReducerCount() = %d, expected nil and 2", err, f.ReducerCount())
+	}
+	var snapshot bytes.Buffer
+	if err := f.Snapshot(&snapshot); err != nil {
+		t.Fatalf("Snapshot() = %v", err)
+	}
+	if err := f.Restore(&snapshot); err != nil {
+		t.Fatalf("Restore() = %v", err)
+	}
+	if got := f.Query("TCP"); got != 600 {
+		t.Errorf("Query(%q) = %d after Restore(), expected 600", "TCP", got)
+	}
+	if err := f.Err(); err != nil {
+		t.Errorf("Err() = %v, expected nil", err)
+	}
+}
+
+// TestSortWordCounts checks the function SortWordCounts() with predefined test
+// cases.
+func TestSortWordCounts(t *testing.T) {
+	dictionary := map[string]uint{"c": 3, "b": 5, "a": 3, "e": 5, "d": 1}
+	cases := []struct {
+		byCount  bool
+		k        uint
+		expected []WordCount
+	}{
+		{false, 0, []WordCount{{"a", 3}, {"b", 5}, {"c", 3}, {"d", 1}, {"e", 5}}},
+		{true, 0, []WordCount{{"b", 5}, {"e", 5}, {"a", 3}, {"c", 3}, {"d", 1}}},
+		{false, 3, []WordCount{{"a", 3}, {"b", 5}, {"e", 5}}},
+		{true, 3, []WordCount{{"b", 5}, {"e", 5}, {"a", 3}}},
+		{true, 9, []WordCount{{"b", 5}, {"e", 5}, {"a", 3}, {"c", 3}, {"d", 1}}},
+	}
+	for _, c := range cases {
+		if got := SortWordCounts(dictionary, c.byCount, c.k); !equalWordCounts(got, c.expected) {
+			t.Errorf("SortWordCounts(%v, %t, %d) = %v, expected %v", dictionary, c.byCount, c.k, got, c.expected)
+		}
+	}
+	if got := SortWordCounts(nil, true, 0); len(got) != 0 {
+		t.Errorf("SortWordCounts(nil, true, 0) = %v, expected none", got)
+	}
+}
@@ -0,0 +1,91 @@
+package lib
+
+import "slices"
+
+// The Posting struct records an occurrence of a word in the inverted index.
+// "Line" is the line number of the line containing the word.
+// "Offset" is the position of the word in the line (0 for the first word).
+type Posting struct {
+	Line   uint
+	Offset uint
+}
+
+// comparePostings orders postings by line number, then by offset.
+func comparePostings(p1, p2 Posting) int {
+	switch {
+	case p1.Line < p2.Line:
+		return -1
+	case p1.Line > p2.Line:
+		return 1
+	case p1.Offset < p2.Offset:
+		return -1
+	case p1.Offset > p2.Offset:
+		return 1
+	}
+	return 0
+}
+
+// IndexWords is the Mapper used for building an inverted index.
+// It splits the line into words, and emits each word with its Posting.
+// It is the same as the Mapper returned by IndexTokens with a zero Tokenizer.
+func IndexWords(lineNo uint, line string, emit func(string, Posting)) {
+	Tokenizer{}.Tokenize(line, func(word string, offset uint) {
+		emit(word, Posting{lineNo, offset})
+	})
+}
+
+// AppendPosting is the Reducer used for building an inverted index.
+// The accumulated value is the postings list of a word. It is only appended
+// to, so a postings list returned by a query is not modified afterwards.
+func AppendPosting(postings []Posting, posting Posting) []Posting {
+	return append(postings, posting)
+}
+
+// sortedPostings returns a sorted copy of a postings list.
+// The postings arrive at a reducer in no particular order, since the lines
+// are processed by the mappers concurrently. The list is copied before
+// sorting, since its backing array is shared with the reducer.
+func sortedPostings(postings []Posting) []Posting {
+	sorted := slices.Clone(postings)
+	slices.SortFunc(sorted, comparePostings)
+	return sorted
+}
+
+// SetupIndex sets-up a map-reduce network which builds an inverted index of
+// the lines, and creates all the functions required to interact with it. It
+// is the same as calling SetupMapReduce with IndexWords (or IndexTokens if a
+// Tokenizer is set by WithTokenizer) and AppendPosting, except that the
+// postings lists returned are sorted.
+//
+// The return values are:
+// (1) the "map" function which accepts a key (line number) and a value (line);
+// (2) the "query" function which accepts a word and returns its postings list;
+// (3) the "queryAll" function which returns the postings lists of all words
+//     by gathering the local indexes from all reducers;
+// (4) the "shutdown" function which should be called to gracefully terminate
+//     the map-reduce network.
+// Like SetupMapReduce, SetupIndex panics if the counts or the options are
+// invalid.
+func SetupIndex(mapperCount, partitionerCount, reducerCount uint, options ...Option) (
+	func(uint, string),
+	func(string) []Posting,
+	func() map[string][]Posting,
+	func()) {
+
+	c := newConfig(options)
+	mapFunc, query, queryAll, shutdown := SetupMapReduce(mapperCount, partitionerCount, reducerCount, IndexTokens(c.tokenizer), AppendPosting, options...)
+
+	queryIndex := func(word string) []Posting {
+		return sortedPostings(query(word))
+	}
+
+	queryAllIndex := func() map[string][]Posting {
+		index := queryAll()
+		for word, postings := range index {
+			index[word] = sortedPostings(postings)
+		}
+		return index
+	}
+
+	return mapFunc, queryIndex, queryAllIndex, shutdown
+}
@@ -0,0 +1,50 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+)
+
+///////////
+// Tests //
+///////////
+
+// TestSetupIndex checks the functions returned by SetupIndex() with a
+// predefined document.
+func TestSetupIndex(t *testing.T) {
+	lines := []string{
+		"TCP uses a three-way handshake",
+		"",
+		"a SYN then a SYN-ACK then an ACK",
+		"TCP TCP",
+	}
+	mapFunc, query, queryAll, shutdown := SetupIndex(3, 2, 4)
+	defer shutdown()
+	for lineNo, line := range lines {
+		mapFunc(uint(lineNo), line)
+	}
+
+	cases := []struct {
+		word     string
+		expected []Posting
+	}{
+		{"TCP", []Posting{{0, 0}, {3, 0}, {3, 1}}},
+		{"a", []Posting{{0, 2}, {2, 0}, {2, 3}}},
+		{"ACK", []Posting{{2, 7}}},
+		{"UDP", nil},
+	}
+	for _, c := range cases {
+		got := query(c.word)
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("query(%q) = %v, expected %v", c.word, got, c.expected)
+		}
+	}
+
+	index := queryAll()
+	if len(index) != 10 {
+		t.Errorf("queryAll() has %d words, expected 10", len(index))
+	}
+	if got, expected := index["then"], []Posting{{2, 2}, {2, 5}}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("queryAll()[%q] = %v, expected %v", "then", got, expected)
+	}
+}
@@ -1,104 +1,657 @@
 package lib
 
 import (
-	"bufio"
+	"context"
 	"fmt"
 	"hash/fnv"
-	"strings"
+	"net/rpc"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// The Mapper type is the "map" function of a map-reduce job.
+// It is called by the mapper goroutines once for each record passed to the
+// "map" function returned by SetupMapReduce. "lineNo" is the key (line number)
+// of the record, and "record" is the value (line). It calls "emit" once for
+// each key-value pair produced from the record.
+type Mapper[R any, K comparable, V any] func(lineNo uint, record R, emit func(K, V))
+
+// The Reducer type is the "reduce" function of a map-reduce job.
+// It is called by the reducer goroutines once for each value emitted by the
+// Mapper. "acc" is the value accumulated so far for the key (the zero value of
+// A if the key is new), and "value" is the value to be folded into it. The new
+// accumulated value is returned.
+type Reducer[V any, A any] func(acc A, value V) A
+
+// The number interface is the type constraint used by Sum.
+type number interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr |
+		~float32 | ~float64
+}
+
+// CountWords is the Mapper used for counting words.
+// It splits the line into words, and emits each word with a count of 1.
+// It is the same as the Mapper returned by CountTokens with a zero Tokenizer.
+func CountWords(lineNo uint, line string, emit func(string, uint)) {
+	Tokenizer{}.Tokenize(line, func(word string, offset uint) {
+		emit(word, 1)
+	})
+}
+
+// Sum is the Reducer which adds up the values.
+// When it is used with CountWords, the accumulated value is the count.
+func Sum[N number](acc, value N) N {
+	return acc + value
+}
+
+// The config struct holds the settings changed by the options.
+// "mapperCount", "partitionerCount" and "reducerCount" are the numbers of the
+// goroutines of each stage.
+// "bufferSize" is the capacity of every channel between the stages.
+// "tokenizer" is the Tokenizer used for splitting lines into words.
+// "ngrams" describes the n-grams of the words which are counted.
+// "combiner" is the function used for combining two values emitted by the
+// Mapper, with the type func(V, V) V, or nil if the values are not combined.
+// "combineLines" is the number of lines after which the combined values are
+// sent by a mapper.
+// "partitioner" is the Partitioner deciding which reducer a key is sent to.
+// "remoteReducers" are the addresses of the worker processes keeping the
+// dictionaries of the reducers, or nil if the reducers are in this process.
+// "errorHandler" is called with each error reported by the stage goroutines,
+// or nil if the errors are only kept.
+// "approximation" holds the error bounds of the approximate counting mode, or
+// nil if the words are counted exactly.
+// "spill" holds the memory budget of the reducers spilling to disk, or nil if
+// the dictionaries are kept in memory.
+// "batching" holds the thresholds of the batches sent by the mappers.
+type config struct {
+	mapperCount      uint
+	partitionerCount uint
+	reducerCount     uint
+	bufferSize       uint
+	tokenizer        Tokenizer
+	ngrams           NGrams
+	combiner         any
+	combineLines     uint
+	partitioner      Partitioner
+	remoteReducers   []string
+	errorHandler     func(error)
+	approximation    *approximation
+	spill            *spill
+	batching         batching
+}
+
+// The Option type is an optional setting passed to NewNetwork, SetupMapReduce,
+// Setup and SetupIndex.
+type Option func(*config)
+
+// WithMappers returns an Option which sets the number of mapper goroutines.
+// By default, it is the number of CPUs. The mapper count passed to
+// SetupMapReduce, Setup and SetupIndex overrides it.
+func WithMappers(count uint) Option {
+	return func(c *config) {
+		c.mapperCount = count
+	}
+}
+
+// WithPartitioners returns an Option which sets the number of partitioner
+// goroutines. By default, it is 1. The partitioner count passed to
+// SetupMapReduce, Setup and SetupIndex overrides it.
+func WithPartitioners(count uint) Option {
+	return func(c *config) {
+		c.partitionerCount = count
+	}
+}
+
+// WithReducers returns an Option which sets the number of reducer goroutines.
+// By default, it is the number of CPUs. The reducer count passed to
+// SetupMapReduce, Setup and SetupIndex overrides it.
+func WithReducers(count uint) Option {
+	return func(c *config) {
+		c.reducerCount = count
+	}
+}
+
+// WithBufferSize returns an Option which sets the capacity of the channels
+// between the stages. A buffer lets a stage go on while the next stage is
+// busy. By default, the channels are unbuffered. Queries are not affected, since
+// they always wait for the records mapped before.
+func WithBufferSize(size uint) Option {
+	return func(c *config) {
+		c.bufferSize = size
+	}
+}
+
+// The batching struct holds the thresholds of the batches sent by the
+// mappers, set by WithBatching.
+// "size" is the number of key-value pairs in a full batch. If it is 0 or 1,
+// the pairs are sent one by one.
+// "latency" is the longest time a pair waits in a batch which is not full, or
+// 0 if a batch waits until it is full or the network is flushed.
+type batching struct {
+	size    uint
+	latency time.Duration
+}
+
+// WithBatching returns an Option which makes the stages exchange batches of
+// key-value pairs, instead of one message for each pair. A mapper sends a
+// batch when it has "size" pairs, or when "latency" has passed since its
+// first pair is collected (if "latency" is not 0). A partitioner splits a
+// batch into one batch for each reducer. This cuts the synchronization on the
+// channels between the stages by about "size" times (see the benchmarks). By
+// default, the pairs are sent one by one.
+//
+// The batches are invisible to the callers: the queries always wait for the
+// batches holding the lines mapped before, so the results are not affected.
+// Only the lines mapped between two queries may wait up to "latency" before
+// they reach the reducers. "Stats().Routed" still counts the pairs, while the
+// queue depths count the batches.
+func WithBatching(size uint, latency time.Duration) Option {
+	return func(c *config) {
+		c.batching = batching{size, latency}
+	}
+}
+
+// withStageCounts returns an Option which sets the numbers of the goroutines
+// of all stages. It is appended to the options by the setup functions which
+// take the counts as arguments.
+func withStageCounts(mapperCount, partitionerCount, reducerCount uint) Option {
+	return func(c *config) {
+		c.mapperCount = mapperCount
+		c.partitionerCount = partitionerCount
+		c.reducerCount = reducerCount
+	}
+}
+
+// WithTokenizer returns an Option which sets the Tokenizer used for splitting
+// lines into words. By default, the zero Tokenizer is used.
+func WithTokenizer(t Tokenizer) Option {
+	return func(c *config) {
+		c.tokenizer = t
+	}
+}
+
+// WithCombiner returns an Option which makes each mapper pre-aggregate the
+// values it emits, before sending them to the partitioners. The values
+// emitted for the same key from "lines" consecutive lines received by a
+// mapper are combined into one by "combine", and sent as one message. This
+// cuts the number of messages going through the partitioners and reducers.
+// When counting words, "combine" is Sum, and a word appearing n times is sent
+// as a single count of n instead of n counts of 1.
+//
+// "combine" must be a function such that reducing the combined value gives
+// the same result as reducing the values one by one. Its type parameter must
+// be the same as the value type of the Mapper, or the setup fails. If
+// "lines" is 0, it is treated as 1 (combining per line).
+//
+// The combined values are always sent before a query is answered, so the
+// results are not affected by the batching.
+func WithCombiner[V any](combine func(V, V) V, lines uint) Option {
+	return func(c *config) {
+		c.combiner = combine
+		c.combineLines = max(lines, 1)
+	}
+}
+
+// WithPartitioner returns an Option which sets the Partitioner deciding which
+// reducer a key is sent to. By default, FNVPartitioner is used.
+func WithPartitioner(p Partitioner) Option {
+	return func(c *config) {
+		c.partitioner = p
+	}
+}
+
+// WithRemoteReducers returns an Option which keeps the dictionaries of the
+// reducers in worker processes, one reducer for each address, instead of in
+// this process. The reducer count passed to the setup function is ignored.
+// The worker processes must be running ServeReducer on the addresses. Only
+// networks counting words (NewNetwork and Setup) support this option, and
+// their reducers could not be scaled.
+func WithRemoteReducers(addresses ...string) Option {
+	return func(c *config) {
+		c.remoteReducers = addresses
+	}
+}
+
+// WithErrorHandler returns an Option which sets the function called with each
+// error reported by the stage goroutines, such as a StageError when the
+// Mapper, Partitioner or Reducer panics. It is called by the stage goroutines
+// concurrently, and must not interact with the network, or it may deadlock.
+// By default, the errors are only kept (see Network.Err).
+func WithErrorHandler(handler func(error)) Option {
+	return func(c *config) {
+		c.errorHandler = handler
+	}
+}
+
+// newConfig returns the config with the options applied to the defaults.
+func newConfig(options []Option) config {
+	c := config{
+		mapperCount:      uint(runtime.NumCPU()),
+		partitionerCount: 1,
+		reducerCount:     uint(runtime.NumCPU()),
+		partitioner:      FNVPartitioner{},
+	}
+	for _, option := range options {
+		option(&c)
+	}
+	return c
+}
+
 // The messageType enum used in the message struct.
 type messageType uint
 
 const (
 	MAP messageType = iota
 	QUERY
+	QUERY_ALL
+	FLUSH
+	VISIT
+	DISTINCT
+	BATCH
+	ADD
+	DELETE
+	RESET
 )
 
+// The record struct used for sending a record to the mapper.
+// "lineNo" is the key (line number) of the record.
+// "content" is the value (line) of the record.
+// "flushChannel" is nil for an ordinary record. Otherwise, the record is a
+// flush marker, and the mapper sends "true" to "flushChannel" after all the
+// records received before it are processed.
+type record[R any] struct {
+	lineNo       uint
+	content      R
+	flushChannel chan<- bool
+}
+
 // The result struct used for returning a result from a query.
-// "word" is the word to be counted.
-// "count" is the number of occurrences of the word.
-type result struct {
-	word  string
-	count uint
+// "key" is the key being queried (a word when counting words).
+// "value" is the accumulated value of the key (its count when counting words).
+// "done" is true if it is the last result sent by a reducer for a QUERY_ALL
+// or DISTINCT, or the result sent by a reducer after a VISIT, ADD, DELETE or
+// RESET.
+// "fanout" is non-zero if it is the result sent by a partitioner for a
+// QUERY_ALL, VISIT, DISTINCT or RESET, telling the number of reducers the message is
+// forwarded to, and hence the number of results with "done" set to true to be
+// waited.
+// "distinct" is the number of distinct keys of a reducer, in the result sent
+// for a DISTINCT.
+type result[K comparable, A any] struct {
+	key      K
+	value    A
+	done     bool
+	fanout   int
+	distinct uint
+}
+
+// The pair struct is a key-value pair emitted by the Mapper, sent in a BATCH.
+type pair[K comparable, V any] struct {
+	key   K
+	value V
 }
 
 // The message struct used for sending a query to the map-reduce network.
-// "Type" is the type of the message, which could be MAP or QUERY.
-// "content" is the content of the message:
-// (1) If it is sent to the mapper, "content" is a line from the input document;
-// (2) If it is sent to the partitioner or the reducer, "content" is a word,
-//     which represents an occurrence of the word (when "Type" is MAP),
-//     or the word to be found (when "Type" is QUERY);
-// (3) If the "Type" is QUERY, and the "content" is an empty string (""),
-//     the query means "show all values in the dictionary".
-// "replyChannel" is used by the reducer to reply the result when "Type" is QUERY.
-type message struct {
+// "Type" is the type of the message, which could be MAP, QUERY, QUERY_ALL,
+// FLUSH, VISIT, DISTINCT, BATCH, ADD, DELETE or RESET.
+// "key" is the key of the message:
+// (1) If "Type" is MAP, "key" is a key emitted by the Mapper, and "value" is
+//     the value emitted with it;
+// (2) If "Type" is QUERY, "key" is the key to be found;
+// (3) If "Type" is QUERY_ALL, "key" is not used, and the query means
+//     "show all values in the dictionary";
+// (4) If "Type" is FLUSH, "key" is not used, and the message is handled by the
+//     partitioner only (see partitionerRoutine);
+// (5) If "Type" is VISIT, "key" is not used, and "visit" is called by every
+//     reducer with its local dictionary (or by one reducer, if the message is
+//     sent to a reducer channel directly). If "keyed" is true, "visit" is
+//     called only by the reducer of "key" (see visitKey). If "visit" is nil,
+//     the message is only replied, as a barrier (see barrier);
+// (6) If "Type" is DISTINCT, "key" is not used, and the query means
+//     "count the distinct keys in the dictionary";
+// (7) If "Type" is BATCH, "key" is not used, and "pairs" holds the key-value
+//     pairs emitted by the Mapper, each handled as if it is sent in a MAP
+//     (see WithBatching);
+// (8) If "Type" is ADD, "key" is the key whose value "delta" is added to,
+//     without going through the Reducer (see addDelta);
+// (9) If "Type" is DELETE, "key" is the key to be removed from the
+//     dictionary;
+// (10) If "Type" is RESET, "key" is not used, and the message means
+//     "remove all keys from the dictionary".
+// "replyChannel" is used by the reducer to reply the result when "Type" is
+// QUERY, QUERY_ALL, VISIT, DISTINCT, ADD, DELETE or RESET, and by the
+// partitioner to acknowledge a FLUSH.
+// "releaseChannel" is closed when the partitioner may resume after a FLUSH.
+// "filter" describes the part of the dictionary "visit" reads when "Type" is
+// VISIT, or nil if it is not known. It is used by a reducer running in another
+// process to send only that part of its dictionary (see remote.go).
+// "cancel" is closed when the caller gives up waiting for the reply, so that
+// the results are no longer sent (see reply). It is nil if the caller always
+// waits.
+// "keyed" is true if a VISIT is forwarded by "key", like a QUERY.
+type message[K comparable, V any, A any] struct {
 	// Since "type" is a keyword in Go, "Type" is used in the following line
-	Type         messageType
-	content      string
-	replyChannel chan<- result
+	Type           messageType
+	key            K
+	value          V
+	replyChannel   chan<- result[K, A]
+	releaseChannel <-chan bool
+	visit          func(map[K]A)
+	filter         any
+	cancel         <-chan struct{}
+	pairs          []pair[K, V]
+	delta          int64
+	keyed          bool
+}
+
+// each calls f with the key-value pair of a MAP, or with each key-value pair
+// of a BATCH, in order.
+func (msg message[K, V, A]) each(f func(key K, value V)) {
+	if msg.Type == BATCH {
+		for _, p := range msg.pairs {
+			f(p.key, p.value)
+		}
+		return
+	}
+	f(msg.key, msg.value)
+}
+
+// reply sends a result to "replyChannel", unless "cancel" is closed before
+// the result is received. It returns whether the result is sent, so that a
+// goroutine replying many results could stop when the caller is gone.
+func (msg message[K, V, A]) reply(res result[K, A]) bool {
+	select {
+	case msg.replyChannel <- res:
+		return true
+	case <-msg.cancel:
+		return false
+	}
+}
+
+// sendContext sends value to channel, unless ctx is done first. It returns the
+// error of ctx if the value is not sent. A done ctx is checked first, so that
+// nothing is sent with it even if channel is ready.
+func sendContext[T any](ctx context.Context, channel chan<- T, value T) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case channel <- value:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// receiveContext receives a value from channel, unless ctx is done first. It
+// returns the error of ctx if no value is received.
+func receiveContext[T any](ctx context.Context, channel <-chan T) (T, error) {
+	select {
+	case value := <-channel:
+		return value, nil
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// keyString returns the textual representation of a key.
+// Strings are returned as is, and other types are formatted with fmt.Sprint.
+func keyString[K comparable](key K) string {
+	if s, ok := any(key).(string); ok {
+		return s
+	}
+	return fmt.Sprint(key)
+}
+
+// hashCode returns the FNV-1a hash of a string as an unsigned 32-bit integer.
+// What "FNV-1a" really is is not important.
+// This function could be treated as the same as Object#hashCode() in Java.
+func hashCode(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
 }
 
 // mapperRoutine is the function executed by the mapper goroutines.
 // Each mapper goroutine executes the same function, but with different parameters.
-// When a line is received from mapperChannel, it is split by the function to words.
-// Each word is then sent to partitionerChannel for further processing.
-func mapperRoutine(
-	mapperChannel <-chan string,
-	partitionerChannel chan<- message,
-	syncChannel chan<- bool) {
-
-	for line := range mapperChannel {
-		reader := strings.NewReader(line)
-		scanner := bufio.NewScanner(reader)
-		scanner.Split(bufio.ScanWords)
-		for scanner.Scan() {
-			word := scanner.Text()
-			partitionerChannel <- message{MAP, word, nil}
+// When a record is received from mapperChannel, it is passed to the Mapper.
+// Each key-value pair emitted is then sent to partitionerChannel for further processing.
+// When a flush marker is received, "true" is sent to its "flushChannel".
+//
+// If "combine" is not nil, the values emitted are combined per key in
+// "pending" instead, and sent after every "combineLines" records, before
+// replying a flush marker, and before terminating.
+//
+// If the batch size "b.size" is more than 1, the key-value pairs are collected
+// in "batch" instead of being sent one by one, and sent in a BATCH when it has
+// "b.size" pairs, when "b.latency" (if not 0) has passed since its first pair
+// is collected, before replying a flush marker, and before terminating.
+//
+// If the Mapper panics, the panic is passed to "report" as a StageError, and
+// the next record is handled. The key-value pairs emitted before the panic
+// are kept.
+func mapperRoutine[R any, K comparable, V any, A any](
+	mapper Mapper[R, K, V],
+	combine func(V, V) V,
+	combineLines uint,
+	b batching,
+	mapperChannel <-chan record[R],
+	partitionerChannel chan<- message[K, V, A],
+	syncChannel chan<- bool,
+	report func(error)) {
+
+	send := func(key K, value V) {
+		partitionerChannel <- message[K, V, A]{Type: MAP, key: key, value: value}
+	}
+
+	var batch []pair[K, V]
+	var timer *time.Timer
+	var timeout <-chan time.Time
+	sendBatch := func() {
+		if len(batch) > 0 {
+			partitionerChannel <- message[K, V, A]{Type: BATCH, pairs: batch}
+			batch = nil
+		}
+		if timeout != nil {
+			timer.Stop()
+			timeout = nil
+		}
+	}
+	if b.size > 1 {
+		send = func(key K, value V) {
+			batch = append(batch, pair[K, V]{key, value})
+			if uint(len(batch)) >= b.size {
+				sendBatch()
+			} else if len(batch) == 1 && b.latency > 0 {
+				if timer == nil {
+					timer = time.NewTimer(b.latency)
+				} else {
+					timer.Reset(b.latency)
+				}
+				timeout = timer.C
+			}
+		}
+	}
+
+	emit := send
+	var pending map[K]V
+	pendingLines := uint(0)
+	sendPending := func() {
+		for key, value := range pending {
+			send(key, value)
+		}
+		clear(pending)
+		pendingLines = 0
+	}
+	if combine != nil {
+		pending = make(map[K]V)
+		emit = func(key K, value V) {
+			if acc, ok := pending[key]; ok {
+				pending[key] = combine(acc, value)
+			} else {
+				pending[key] = value
+			}
 		}
 	}
+
+	for {
+		var rec record[R]
+		var ok bool
+		select {
+		case rec, ok = <-mapperChannel:
+		case <-timeout:
+			timeout = nil
+			sendBatch()
+			continue
+		}
+		if !ok {
+			break
+		}
+		if rec.flushChannel != nil {
+			sendPending()
+			sendBatch()
+			rec.flushChannel <- true
+			continue
+		}
+		protect("mapper", lineInput(rec.lineNo), report, func() {
+			mapper(rec.lineNo, rec.content, emit)
+		})
+		if combine != nil {
+			pendingLines++
+			if pendingLines >= combineLines {
+				sendPending()
+			}
+		}
+	}
+	sendPending()
+	sendBatch()
 	syncChannel <- true
 }
 
+// The routingTable struct holds the reducer channels which the partitioners
+// forward messages to. It is shared by all partitioner goroutines.
+// "mutex" is read-locked by a partitioner while it forwards a message, and is
+// write-locked while reducers are added or removed (see scaleReducers), so
+// that no message is forwarded with an outdated "reducerChannels".
+// "routed" counts the messages forwarded by key (MAP, QUERY, ADD and DELETE),
+// and the key-value pairs in the BATCH messages, forwarded to each reducer. It has the same length as
+// "reducerChannels".
+type routingTable[K comparable, V any, A any] struct {
+	mutex           sync.RWMutex
+	reducerChannels []chan message[K, V, A]
+	routed          []*atomic.Uint64
+}
+
 // partitionerRoutine is the function executed by the partitioner goroutines.
 // Each partitioner goroutine executes the same function, with same parameters.
-// There are three types of requests:
-// (1) If the "Type" is MAP, the hash code of "content" is calculated,
-//     and the message is forworded to one of the reducerChannels determined by the hash code;
-// (2) If the "Type" is QUERY and the "content" is not an empty string (""),
-//     the hash code of "content" is calculated, and the message is forwarded like (1);
-// (3) If the "Type" is QUERY and the "content" is an empty string (""),
-//     the message is forwarded to all reducerChannels.
-func partitionerRoutine(
-	partitionerChannel <-chan message,
-	reducerChannels []chan<- message,
-	syncChannel chan<- bool) {
-
-	// hashCode returns the FNV-1a hash of a string as an unsigned 32-bit integer.
-	// What "FNV-1a" really is is not important.
-	// This function could be treated as the same as Object#hashCode() in Java.
-	hashCode := func(s string) uint32 {
-		h := fnv.New32a()
-		h.Write([]byte(s))
-		return h.Sum32()
-	}
-	reducerCount := uint32(len(reducerChannels))
+// There are five types of requests:
+// (1) If the "Type" is MAP, the Partitioner is called with "key",
+//     and the message is forworded to one of the reducerChannels determined by it;
+// (2) If the "Type" is QUERY, ADD or DELETE, the Partitioner is called with
+//     "key", and the message is forwarded like (1);
+// (3) If the "Type" is QUERY_ALL, VISIT, DISTINCT or RESET, a result with "fanout" set to the
+//     number of reducers is sent to "replyChannel", and the message is
+//     forwarded to all reducerChannels. A VISIT with "keyed" set to true is
+//     forwarded like (2) instead, without a "fanout";
+// (4) If the "Type" is FLUSH, a result is sent to "replyChannel" to signal that
+//     all messages received before have been forwarded, and the goroutine
+//     blocks until "releaseChannel" is closed, so that it does not receive
+//     another FLUSH which belongs to the same flush;
+// (5) If the "Type" is BATCH, the Partitioner is called with the key of each
+//     pair, and the pairs are split into one BATCH for each reducer, which is
+//     forwarded like (1). The pairs are not kept for the next BATCH, so no
+//     pair is left in a partitioner when the reducers are scaled.
+//
+// If the Partitioner panics, or returns an index out of range, a StageError is
+// passed to "report". A MAP (or a pair in a BATCH) is then dropped, a QUERY
+// is replied with the zero value, and an ADD, a DELETE or a keyed VISIT is
+// dropped and replied with a result with "done" set to true, so that the
+// caller does not wait forever.
+func partitionerRoutine[K comparable, V any, A any](
+	partitioner Partitioner,
+	partitionerChannel <-chan message[K, V, A],
+	routing *routingTable[K, V, A],
+	syncChannel chan<- bool,
+	report func(error)) {
+
+	// route returns the index of the reducer which a key is forwarded to, out
+	// of reducerCount reducers, and whether the Partitioner succeeds.
+	route := func(key K, reducerCount int) (int, bool) {
+		i := -1
+		ok := protect("partitioner", keyInput(key), report, func() {
+			i = partitioner.Partition(keyString(key), reducerCount)
+		})
+		if ok && (i < 0 || i >= reducerCount) {
+			report(&StageError{
+				Stage: "partitioner",
+				Input: keyInput(key)(),
+				Value: fmt.Sprintf("%T returned %d, not in [0, %d)", partitioner, i, reducerCount),
+			})
+			ok = false
+		}
+		return i, ok
+	}
+
+	// forward forwards a message to the reducer of its key, and returns
+	// whether the Partitioner succeeds.
+	forward := func(msg message[K, V, A]) bool {
+		routing.mutex.RLock()
+		defer routing.mutex.RUnlock()
+		reducerChannels := routing.reducerChannels
+		i, ok := route(msg.key, len(reducerChannels))
+		if ok {
+			reducerChannels[i] <- msg
+			routing.routed[i].Add(1)
+		}
+		return ok
+	}
 
 	for msg := range partitionerChannel {
-		word := msg.content
-		hc := hashCode(word)
 		switch msg.Type {
-		case MAP:
-			reducerChannels[hc%reducerCount] <- msg
-		case QUERY:
-			if word == "" {
-				for _, rc := range reducerChannels {
+		case MAP, QUERY, ADD, DELETE:
+			if ok := forward(msg); !ok && msg.Type == QUERY {
+				msg.reply(result[K, A]{key: msg.key})
+			} else if !ok && (msg.Type == ADD || msg.Type == DELETE) {
+				msg.reply(result[K, A]{done: true})
+			}
+		case BATCH:
+			routing.mutex.RLock()
+			reducerChannels := routing.reducerChannels
+			batches := make([][]pair[K, V], len(reducerChannels))
+			for _, p := range msg.pairs {
+				if i, ok := route(p.key, len(reducerChannels)); ok {
+					batches[i] = append(batches[i], p)
+				}
+			}
+			for i, pairs := range batches {
+				if len(pairs) > 0 {
+					reducerChannels[i] <- message[K, V, A]{Type: BATCH, pairs: pairs}
+					routing.routed[i].Add(uint64(len(pairs)))
+				}
+			}
+			routing.mutex.RUnlock()
+		case QUERY_ALL, VISIT, DISTINCT, RESET:
+			if msg.keyed {
+				if !forward(msg) {
+					msg.reply(result[K, A]{done: true})
+				}
+				break
+			}
+			routing.mutex.RLock()
+			if msg.reply(result[K, A]{fanout: len(routing.reducerChannels)}) {
+				for _, rc := range routing.reducerChannels {
 					rc <- msg
 				}
-			} else {
-				reducerChannels[hc%reducerCount] <- msg
 			}
+			routing.mutex.RUnlock()
+		case FLUSH:
+			msg.replyChannel <- result[K, A]{done: true}
+			<-msg.releaseChannel
 		default:
 			panic(fmt.Sprintf("Unknown case: %d", msg.Type))
 		}
@@ -108,33 +661,103 @@ func partitionerRoutine(
 
 // reducerRoutine is the function executed by the reducer goroutines.
 // Each reducer goroutine executes the same function, but with different parameters.
-// There are three types of requests:
-// (1) If the "Type" is MAP, the count of the "content" is increased by 1;
-// (2) If the "Type" is QUERY and the "content" is not an empty string (""),
-//     the count of the "content" is sent to "replyChannel";
-// (3) If the "Type" is QUERY and the "content" is an empty string (""),
-//     the whole dictionary is sent to the "replyChannel",
-//     and a "zero value" for the result struct is sent at the end to signal termination.
-func reducerRoutine(
-	reducerChannel <-chan message,
-	syncChannel chan<- bool) {
-
-	dictionary := make(map[string]uint)
+// There are eight types of requests:
+// (1) If the "Type" is MAP, the "value" is folded into the value of "key" by
+//     the Reducer. A BATCH is handled as a MAP for each of its pairs;
+// (2) If the "Type" is QUERY, the value of "key" is sent to "replyChannel";
+// (3) If the "Type" is QUERY_ALL, the whole dictionary is sent to the
+//     "replyChannel", and a result with "done" set to true is sent at the end
+//     to signal termination;
+// (4) If the "Type" is VISIT, "visit" is called with the whole dictionary,
+//     and a result with "done" set to true is sent to "replyChannel" after it
+//     returns. If "visit" is nil, only the result is sent;
+// (5) If the "Type" is DISTINCT, the size of the dictionary is sent to
+//     "replyChannel" as "distinct", followed by a result with "done" set to
+//     true;
+// (6) If the "Type" is ADD, "delta" is added to the value of "key" by
+//     addDelta. The key is removed if its value becomes zero. A result with
+//     "done" set to true is then sent to "replyChannel";
+// (7) If the "Type" is DELETE, "key" is removed from the dictionary, and a
+//     result with "done" set to true is sent to "replyChannel";
+// (8) If the "Type" is RESET, the dictionary is cleared, and a result with
+//     "done" set to true is sent to "replyChannel".
+// The results are not sent once "cancel" of the message is closed.
+// After the value of a key is changed by MAP, BATCH, ADD, DELETE or RESET, the
+// watchers in "ws" matching the key are notified (see watch). The changes
+// made by "visit" are not notified.
+//
+// If the Reducer or "visit" panics, or a delta could not be added to the
+// values, the error is passed to "report" as a StageError. The value of the
+// key is then left unchanged, and a VISIT is still replied.
+func reducerRoutine[K comparable, V any, A any](
+	reducer Reducer[V, A],
+	ws *watchers[K, A],
+	reducerChannel <-chan message[K, V, A],
+	syncChannel chan<- bool,
+	report func(error)) {
+
+	dictionary := make(map[K]A)
 	for msg := range reducerChannel {
-		word := msg.content
 		switch msg.Type {
-		case MAP:
-			dictionary[word]++
+		case MAP, BATCH:
+			msg.each(func(key K, value V) {
+				old := dictionary[key]
+				ok := protect("reducer", keyInput(key), report, func() {
+					dictionary[key] = reducer(old, value)
+				})
+				if ok {
+					ws.changed(key, old, dictionary[key], report)
+				}
+			})
 		case QUERY:
-			rc := msg.replyChannel
-			if word == "" {
-				for word, count := range dictionary {
-					rc <- result{word, count}
+			msg.reply(result[K, A]{key: msg.key, value: dictionary[msg.key]})
+		case QUERY_ALL:
+			for key, value := range dictionary {
+				if !msg.reply(result[K, A]{key: key, value: value}) {
+					break
 				}
-				rc <- result{"", 0}
+			}
+			msg.reply(result[K, A]{done: true})
+		case VISIT:
+			if msg.visit != nil {
+				protect("reducer", visitInput, report, func() {
+					msg.visit(dictionary)
+				})
+			}
+			msg.reply(result[K, A]{done: true})
+		case DISTINCT:
+			msg.reply(result[K, A]{distinct: uint(len(dictionary))})
+			msg.reply(result[K, A]{done: true})
+		case ADD:
+			old := dictionary[msg.key]
+			value, zero, err := addDelta(old, msg.delta)
+			if err != nil {
+				report(&StageError{Stage: "reducer", Input: keyInput(msg.key)(), Value: err})
 			} else {
-				rc <- result{word, dictionary[word]}
+				if zero {
+					delete(dictionary, msg.key)
+				} else {
+					dictionary[msg.key] = value
+				}
+				ws.changed(msg.key, old, value, report)
+			}
+			msg.reply(result[K, A]{done: true})
+		case DELETE:
+			if old, ok := dictionary[msg.key]; ok {
+				delete(dictionary, msg.key)
+				var zero A
+				ws.changed(msg.key, old, zero, report)
 			}
+			msg.reply(result[K, A]{done: true})
+		case RESET:
+			if len(ws.load()) > 0 {
+				var zero A
+				for key, old := range dictionary {
+					ws.changed(key, old, zero, report)
+				}
+			}
+			clear(dictionary)
+			msg.reply(result[K, A]{done: true})
 		default:
 			panic(fmt.Sprintf("Unknown case: %d", msg.Type))
 		}
@@ -142,22 +765,57 @@ func reducerRoutine(
 	syncChannel <- true
 }
 
-// Setup sets-up all the channels required to build the map-reduce network, and
-// creates all the functions required to interact with it. The channels are
-// encapsulated in the closures and are not visible outside.
-//
-// The return values are:
-// (1) the "map" function which accepts a key (line number) and a value (line);
-// (2) the "query" function which accepts a keyword and returns its count;
-// (3) the "queryAll" function which returns the whole dictionary by gathering
-//     the local dictionaries from all reducers;
-// (4) the "shutdown" function which should be called to gracefully terminate
-//     the map-reduce network.
-func Setup(mapperCount, partitionerCount, reducerCount uint) (
-	func(uint, string),
-	func(string) uint,
-	func() map[string]uint,
-	func()) {
+// The network struct holds the channels of a map-reduce network.
+// Its methods are returned as closures by SetupMapReduce, so the channels are
+// not visible outside.
+type network[R any, K comparable, V any, A any] struct {
+	mapperChannels     []chan record[R]
+	partitionerChannel chan message[K, V, A]
+	routing            routingTable[K, V, A]
+	partitionerCount   uint
+	syncChannel        chan bool
+	flushLock          chan bool
+	startReducer       func(chan message[K, V, A])
+	partitioner        Partitioner
+	remote             bool
+	approximate        bool
+	errors             errorLog
+	bufferSize         uint
+	counters           counters
+	watchers           watchers[K, A]
+}
+
+// newNetwork sets-up all the channels and goroutines of a map-reduce network.
+// If the counts or the config are invalid, or the remote reducers could not be
+// connected, no goroutine is started, and a non-nil error is returned.
+func newNetwork[R any, K comparable, V any, A any](
+	mapper Mapper[R, K, V],
+	reducer Reducer[V, A],
+	c config) (*network[R, K, V, A], error) {
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	if mapper == nil || reducer == nil {
+		return nil, fmt.Errorf("The mapper and the reducer must not be nil")
+	}
+
+	n := &network[R, K, V, A]{
+		partitionerCount: c.partitionerCount,
+		partitioner:      c.partitioner,
+		errors:           errorLog{handler: c.errorHandler},
+		bufferSize:       c.bufferSize,
+		flushLock:        make(chan bool, 1),
+	}
+
+	var combine func(V, V) V
+	if c.combiner != nil {
+		var ok bool
+		combine, ok = c.combiner.(func(V, V) V)
+		if !ok {
+			return nil, fmt.Errorf("The combiner %T does not accept the values emitted by the mapper", c.combiner)
+		}
+	}
 
 	// Setup the "syncChannel".
 	//
@@ -166,104 +824,455 @@ func Setup(mapperCount, partitionerCount, reducerCount uint) (
 	// "syncChannel" before returning (aka. terminating the goroutine). The
 	// caller waits for this message to ensure that the code is terminated
 	// gracefully.
-	syncChannel := make(chan bool)
+	n.syncChannel = make(chan bool)
 
 	// Setup the "reducerChannels".
 	//
 	// The "reducerChannels" are used by "partitionerRoutine" / "reducerRoutine"
-	// to communicate. "partitionerRoutine" knows all "reducerChannels" and
-	// selects which one to communicate each time, while "reducerRoutine" knows
-	// only one of them that are designated to the particular goroutine (similar
-	// to thread) which executes it.
+	// to communicate. "partitionerRoutine" knows all "reducerChannels" (through
+	// the routing table) and selects which one to communicate each time, while
+	// "reducerRoutine" knows only one of them that are designated to the
+	// particular goroutine (similar to thread) which executes it.
 	//
-	// "reducerChannelsForInput" reference to the same instances as
-	// "reducerChannels", but with a different data type - they are "send-only".
-	// Specifying the direction of channels is considered a good habit and helps
-	// the code to be understood.
-	reducerChannels := make([]chan message, reducerCount)
-	reducerChannelsForInput := make([]chan<- message, reducerCount)
-	for i, _ := range reducerChannels {
-		reducerChannels[i] = make(chan message)
-		reducerChannelsForInput[i] = reducerChannels[i]
-		go reducerRoutine(reducerChannels[i], syncChannel)
+	// If the reducers are remote, each "reducerRoutine" is replaced by a
+	// "remoteReducerRoutine", which forwards the messages to a worker process.
+	// If the counting is approximate, each "reducerRoutine" is replaced by a
+	// "sketchReducerRoutine", which keeps sketches instead of a dictionary.
+	// If the reducers spill to disk, each "reducerRoutine" is replaced by a
+	// "spillReducerRoutine", which moves its dictionary to files when it
+	// exceeds the memory budget. "startReducer" starts the reducers added when
+	// the reducers are scaled.
+	if c.approximation != nil {
+		startSketch, ok := any(sketchReducerRoutine).(func(approximation, <-chan message[K, V, A], chan<- bool, func(error)))
+		if !ok {
+			return nil, fmt.Errorf("Approximate counting only supports counting words")
+		}
+		n.approximate = true
+		n.routing.reducerChannels = make([]chan message[K, V, A], c.reducerCount)
+		for i := range n.routing.reducerChannels {
+			n.routing.reducerChannels[i] = make(chan message[K, V, A], c.bufferSize)
+			go startSketch(*c.approximation, n.routing.reducerChannels[i], n.syncChannel, n.errors.report)
+		}
+	} else if len(c.remoteReducers) > 0 {
+		startRemote, ok := any(remoteReducerRoutine).(func(*rpc.Client, <-chan message[K, V, A], chan<- bool, func(error)))
+		if !ok {
+			return nil, fmt.Errorf("Remote reducers only support counting words")
+		}
+		clients, err := dialReducers(c.remoteReducers)
+		if err != nil {
+			return nil, err
+		}
+		n.remote = true
+		n.routing.reducerChannels = make([]chan message[K, V, A], len(clients))
+		for i, client := range clients {
+			n.routing.reducerChannels[i] = make(chan message[K, V, A], c.bufferSize)
+			go startRemote(client, n.routing.reducerChannels[i], n.syncChannel, n.errors.report)
+		}
+	} else {
+		n.startReducer = func(reducerChannel chan message[K, V, A]) {
+			go reducerRoutine(reducer, &n.watchers, reducerChannel, n.syncChannel, n.errors.report)
+		}
+		if c.spill != nil {
+			startSpill, ok := any(spillReducerRoutine).(func(spill, *watchers[K, A], <-chan message[K, V, A], chan<- bool, func(error)))
+			if !ok {
+				return nil, fmt.Errorf("Spilling to disk only supports counting words")
+			}
+			n.startReducer = func(reducerChannel chan message[K, V, A]) {
+				go startSpill(*c.spill, &n.watchers, reducerChannel, n.syncChannel, n.errors.report)
+			}
+		}
+		n.routing.reducerChannels = make([]chan message[K, V, A], c.reducerCount)
+		for i := range n.routing.reducerChannels {
+			n.routing.reducerChannels[i] = make(chan message[K, V, A], c.bufferSize)
+			n.startReducer(n.routing.reducerChannels[i])
+		}
 	}
+	n.routing.routed = newCounters(len(n.routing.reducerChannels))
 
 	// Setup the "partitionerChannel".
 	//
 	// The "partitionerChannel" is used by "mapperRoutine" / "partitionerRoutine"
 	// to communicate.
-	partitionerChannel := make(chan message)
-	for i := uint(0); i < partitionerCount; i++ {
-		go partitionerRoutine(partitionerChannel, reducerChannelsForInput, syncChannel)
+	n.partitionerChannel = make(chan message[K, V, A], c.bufferSize)
+	for i := uint(0); i < c.partitionerCount; i++ {
+		go partitionerRoutine(c.partitioner, n.partitionerChannel, &n.routing, n.syncChannel, n.errors.report)
 	}
 
 	// Setup the "mapperChannels".
 	//
-	// The "partitionerChannel" is used by "mapFunc" / "mapperRoutine" to
+	// The "mapperChannels" are used by "mapFunc" / "mapperRoutine" to
 	// communicate.
-	mapperChannels := make([]chan string, mapperCount)
-	for i, _ := range mapperChannels {
-		mapperChannels[i] = make(chan string)
-		go mapperRoutine(mapperChannels[i], partitionerChannel, syncChannel)
+	n.mapperChannels = make([]chan record[R], c.mapperCount)
+	// The key-value pairs emitted by the Mapper are counted before they are
+	// combined.
+	countedMapper := func(lineNo uint, record R, emit func(K, V)) {
+		mapper(lineNo, record, func(key K, value V) {
+			n.counters.tokens.Add(1)
+			emit(key, value)
+		})
 	}
-
-	// Since "map" is a keyword in Go, "mapFunc" is used in the following line
-	mapFunc := func(lineNo uint, line string) {
-		mapperChannels[lineNo%mapperCount] <- line
+	for i := range n.mapperChannels {
+		n.mapperChannels[i] = make(chan record[R], c.bufferSize)
+		go mapperRoutine(countedMapper, combine, c.combineLines, c.batching, n.mapperChannels[i], n.partitionerChannel, n.syncChannel, n.errors.report)
 	}
 
-	query := func(word string) uint {
-		replyChannel := make(chan result)
-		defer close(replyChannel)
+	return n, nil
+}
+
+// mapFunc sends a record to one of the mappers in a round-robin manner.
+// Since "map" is a keyword in Go, "mapFunc" is used as the name.
+func (n *network[R, K, V, A]) mapFunc(lineNo uint, content R) {
+	n.mapContext(context.Background(), lineNo, content)
+}
 
-		partitionerChannel <- message{QUERY, word, replyChannel}
-		res := <-replyChannel
-		count := res.count
-		return count
+// mapContext is the same as mapFunc, except that it gives up and returns the
+// error of ctx if ctx is done before the mapper receives the record.
+func (n *network[R, K, V, A]) mapContext(ctx context.Context, lineNo uint, content R) error {
+	mc := n.mapperChannels[lineNo%uint(len(n.mapperChannels))]
+	if err := sendContext(ctx, mc, record[R]{lineNo: lineNo, content: content}); err != nil {
+		return err
 	}
+	n.counters.lines.Add(1)
+	return nil
+}
+
+// reduceValue sends a key-value pair to the partitioners directly, as if it
+// is emitted by a mapper.
+func (n *network[R, K, V, A]) reduceValue(key K, value V) {
+	n.partitionerChannel <- message[K, V, A]{Type: MAP, key: key, value: value}
+}
 
-	queryAll := func() map[string]uint {
-		replyChannel := make(chan result)
-		defer close(replyChannel)
+// flush blocks until every record passed to mapFunc before the call has been
+// fully reduced. It works like a barrier:
+// (1) A flush marker is sent to every mapper. When a mapper replies, all the
+//     key-value pairs emitted from the records before the marker have been
+//     received by the partitioners;
+// (2) A FLUSH message is sent for every partitioner. When all partitioners
+//     reply, all the messages they received before have been received by the
+//     reducers. Since a reducer handles messages in order, any query sent
+//     afterwards sees them.
+// Concurrent flushes are serialized, since the FLUSH messages of two flushes
+// could otherwise be received by the partitioners in an interleaved manner,
+// and each flush would wait for the partitioners held by the other.
+func (n *network[R, K, V, A]) flush() {
+	n.flushContext(context.Background())
+}
 
-		partitionerChannel <- message{QUERY, "", replyChannel}
-		dictionary := make(map[string]uint)
-		channelCount := uint(0)
-		for res := range replyChannel {
-			if res.word == "" {
-				channelCount++
-				if channelCount == reducerCount {
-					break
-				}
-			} else {
-				dictionary[res.word] += res.count
-			}
+// flushContext is the same as flush, except that it gives up and returns the
+// error of ctx if ctx is done before the barrier is passed. Giving up leaves
+// the network consistent: the replies of the flush markers are buffered, and
+// the partitioners which have received a FLUSH are released.
+func (n *network[R, K, V, A]) flushContext(ctx context.Context) error {
+	if err := sendContext(ctx, n.flushLock, true); err != nil {
+		return err
+	}
+	defer func() { <-n.flushLock }()
+
+	flushChannel := make(chan bool, len(n.mapperChannels))
+	for _, mc := range n.mapperChannels {
+		if err := sendContext(ctx, mc, record[R]{flushChannel: flushChannel}); err != nil {
+			return err
+		}
+	}
+	for range n.mapperChannels {
+		if _, err := receiveContext(ctx, flushChannel); err != nil {
+			return err
 		}
-		return dictionary
 	}
 
-	shutdown := func() {
-		// Terminate the mapperRoutines gracefully
-		for _, mc := range mapperChannels {
-			close(mc)
-			<-syncChannel
+	replyChannel := make(chan result[K, A], n.partitionerCount)
+	releaseChannel := make(chan bool)
+	defer close(releaseChannel)
+	for i := uint(0); i < n.partitionerCount; i++ {
+		msg := message[K, V, A]{Type: FLUSH, replyChannel: replyChannel, releaseChannel: releaseChannel}
+		if err := sendContext(ctx, n.partitionerChannel, msg); err != nil {
+			return err
+		}
+	}
+	for i := uint(0); i < n.partitionerCount; i++ {
+		if _, err := receiveContext(ctx, replyChannel); err != nil {
+			return err
 		}
+	}
+	return nil
+}
+
+// query returns the accumulated value of a key.
+// The records passed to mapFunc before the call are all counted.
+func (n *network[R, K, V, A]) query(key K) A {
+	value, _ := n.queryContext(context.Background(), key)
+	return value
+}
+
+// queryContext is the same as query, except that it gives up and returns the
+// error of ctx if ctx is done before the value is received.
+func (n *network[R, K, V, A]) queryContext(ctx context.Context, key K) (A, error) {
+	var zero A
+	if err := n.flushContext(ctx); err != nil {
+		return zero, err
+	}
+
+	replyChannel := make(chan result[K, A], 1)
+	msg := message[K, V, A]{Type: QUERY, key: key, replyChannel: replyChannel, cancel: ctx.Done()}
+	if err := sendContext(ctx, n.partitionerChannel, msg); err != nil {
+		return zero, err
+	}
+	res, err := receiveContext(ctx, replyChannel)
+	if err != nil {
+		return zero, err
+	}
+	n.counters.queries.Add(1)
+	return res.value, nil
+}
+
+// queryAll returns the whole dictionary by gathering the local dictionaries
+// from all reducers.
+// The records passed to mapFunc before the call are all counted.
+func (n *network[R, K, V, A]) queryAll() map[K]A {
+	dictionary, _ := n.queryAllContext(context.Background())
+	return dictionary
+}
 
-		// Terminate the partitionerChannels gracefully
-		close(partitionerChannel)
-		for i := uint(0); i < partitionerCount; i++ {
-			<-syncChannel
+// queryAllContext is the same as queryAll, except that it gives up and returns
+// a nil dictionary and the error of ctx if ctx is done before all the values
+// are received.
+func (n *network[R, K, V, A]) queryAllContext(ctx context.Context) (map[K]A, error) {
+	if err := n.flushContext(ctx); err != nil {
+		return nil, err
+	}
+
+	replyChannel := make(chan result[K, A])
+	msg := message[K, V, A]{Type: QUERY_ALL, replyChannel: replyChannel, cancel: ctx.Done()}
+	if err := sendContext(ctx, n.partitionerChannel, msg); err != nil {
+		return nil, err
+	}
+	dictionary := make(map[K]A)
+	err := receiveAll(ctx, replyChannel, func(res result[K, A]) {
+		dictionary[res.key] = res.value
+	})
+	if err != nil {
+		return nil, err
+	}
+	n.counters.queries.Add(1)
+	return dictionary, nil
+}
+
+// receiveAll receives the results of a QUERY_ALL, VISIT or DISTINCT from
+// replyChannel, and calls handle for each result which is neither a "done"
+// nor a "fanout".
+// It returns after all the reducers the message is forwarded to are done, or
+// returns the error of ctx if ctx is done before that.
+// The "fanout" from the partitioner may arrive after some of the "done"s.
+func receiveAll[K comparable, A any](ctx context.Context, replyChannel <-chan result[K, A], handle func(result[K, A])) error {
+	expectedCount, doneCount := -1, 0
+	for doneCount != expectedCount {
+		res, err := receiveContext(ctx, replyChannel)
+		if err != nil {
+			return err
+		}
+		switch {
+		case res.fanout > 0:
+			expectedCount = res.fanout
+		case res.done:
+			doneCount++
+		default:
+			handle(res)
 		}
+	}
+	return nil
+}
+
+// distinctCount returns the number of distinct keys, by adding up the numbers
+// of distinct keys of all reducers. Since a key belongs to exactly one
+// reducer, no key is counted twice.
+// The records passed to mapFunc before the call are all counted.
+func (n *network[R, K, V, A]) distinctCount() uint {
+	n.flush()
+
+	replyChannel := make(chan result[K, A])
+	n.partitionerChannel <- message[K, V, A]{Type: DISTINCT, replyChannel: replyChannel}
+	count := uint(0)
+	receiveAll(context.Background(), replyChannel, func(res result[K, A]) {
+		count += res.distinct
+	})
+	n.counters.queries.Add(1)
+	return count
+}
+
+// visitKey calls visit in the reducer goroutine keeping key, with its local
+// dictionary, and returns after the call returns. Unlike visitAll, the other
+// reducers are not stopped, and visit is called exactly once (or not at all,
+// if the Partitioner fails), so it could write the result without locking.
+// visit must only read the dictionary.
+// The records passed to mapFunc before the call are all visited.
+func (n *network[R, K, V, A]) visitKey(key K, visit func(map[K]A)) {
+	n.flush()
+
+	replyChannel := make(chan result[K, A])
+	n.partitionerChannel <- message[K, V, A]{Type: VISIT, key: key, keyed: true, replyChannel: replyChannel, visit: visit}
+	<-replyChannel
+	n.counters.queries.Add(1)
+}
 
-		// Terminate the reducerRoutines gracefully
-		for _, rc := range reducerChannels {
-			close(rc)
-			<-syncChannel
+// visitAll calls visit once in every reducer goroutine with its local
+// dictionary, and returns after all the calls return. A reducer spilling to
+// disk calls visit with each part of its dictionary instead, unless "filter"
+// is given (see spillReducerRoutine). It lets a query be
+// answered by the reducers themselves, so that only the (partial) answers,
+// instead of the whole dictionary, are sent back. The calls are made
+// concurrently, each by the reducer goroutine keeping the dictionary, so visit
+// could modify the dictionary it is called with (see Windowed.expire), but
+// must not keep it after returning. "filter" is passed along with visit (see
+// the message struct).
+// The records passed to mapFunc before the call are all visited.
+func (n *network[R, K, V, A]) visitAll(visit func(map[K]A), filter any) {
+	n.flush()
+
+	replyChannel := make(chan result[K, A])
+	n.partitionerChannel <- message[K, V, A]{Type: VISIT, replyChannel: replyChannel, visit: visit, filter: filter}
+	receiveAll(context.Background(), replyChannel, func(result[K, A]) {})
+	n.counters.queries.Add(1)
+}
+
+// barrier returns after every reducer has handled the messages forwarded to
+// it before the call, by sending a VISIT without "visit". Unlike flush, which
+// only waits for the partitioners, the records passed to mapFunc before the
+// call are then all counted.
+func (n *network[R, K, V, A]) barrier() {
+	n.flush()
+
+	replyChannel := make(chan result[K, A])
+	n.partitionerChannel <- message[K, V, A]{Type: VISIT, replyChannel: replyChannel}
+	receiveAll(context.Background(), replyChannel, func(result[K, A]) {})
+}
+
+// shutdown gracefully terminates the map-reduce network.
+func (n *network[R, K, V, A]) shutdown() {
+	n.shutdownContext(context.Background())
+}
+
+// shutdownContext gracefully terminates the map-reduce network, stage by
+// stage: the channels of a stage are closed after all goroutines of the
+// previous stage have terminated, since they send to these channels.
+// If ctx is done before a stage drains, it gives up and returns a DrainError
+// telling the stage and the number of its goroutines still running. The
+// later stages are then left running, since the goroutines of the stuck stage
+// may still send to them.
+func (n *network[R, K, V, A]) shutdownContext(ctx context.Context) error {
+	// wait waits for "count" goroutines of "stage" to terminate.
+	wait := func(stage string, count int) error {
+		for i := 0; i < count; i++ {
+			if _, err := receiveContext(ctx, n.syncChannel); err != nil {
+				return &DrainError{Stage: stage, Running: count - i, Err: err}
+			}
 		}
+		return nil
+	}
+
+	// Cancel the watchers, so that no reducer waits for an update to be
+	// received while terminating
+	n.watchers.stopAll()
+
+	// Terminate the mapperRoutines gracefully
+	for _, mc := range n.mapperChannels {
+		close(mc)
+	}
+	if err := wait("mapper", len(n.mapperChannels)); err != nil {
+		return err
+	}
 
-		// Close syncChannel
-		close(syncChannel)
+	// Terminate the partitionerChannels gracefully
+	close(n.partitionerChannel)
+	if err := wait("partitioner", int(n.partitionerCount)); err != nil {
+		return err
 	}
 
-	return mapFunc, query, queryAll, shutdown
+	// Terminate the reducerRoutines gracefully
+	for _, rc := range n.routing.reducerChannels {
+		close(rc)
+	}
+	if err := wait("reducer", len(n.routing.reducerChannels)); err != nil {
+		return err
+	}
+
+	// Close syncChannel
+	close(n.syncChannel)
+	return nil
+}
+
+// SetupMapReduce sets-up all the channels required to build a map-reduce
+// network running the given Mapper and Reducer, and creates all the functions
+// required to interact with it. The channels are encapsulated in the closures
+// and are not visible outside.
+//
+// The return values are:
+// (1) the "map" function which accepts a key (line number) and a value (record);
+// (2) the "query" function which accepts a key and returns its accumulated value;
+// (3) the "queryAll" function which returns the whole dictionary by gathering
+//     the local dictionaries from all reducers;
+// Both "query" and "queryAll" wait until every record passed to "map" before
+// the call has been reduced, so the result does not depend on the number of
+// mappers, partitioners and reducers.
+// (4) the "shutdown" function which should be called to gracefully terminate
+//     the map-reduce network.
+// The options, such as WithCombiner, change how the network works.
+//
+// SetupMapReduce panics if the counts or the options are invalid, such as a
+// count of 0. A Mapper, Partitioner or Reducer which panics does not stop the
+// network: the message is skipped, and the error is passed to the handler set
+// by WithErrorHandler.
+//
+// Example (max-per-key):
+//
+//	mapFunc, query, queryAll, shutdown := SetupMapReduce(4, 1, 4,
+//		func(lineNo uint, r Reading, emit func(string, int)) { emit(r.Sensor, r.Value) },
+//		func(acc int, value int) int { return max(acc, value) })
+func SetupMapReduce[R any, K comparable, V any, A any](
+	mapperCount, partitionerCount, reducerCount uint,
+	mapper Mapper[R, K, V],
+	reducer Reducer[V, A],
+	options ...Option) (
+	func(uint, R),
+	func(K) A,
+	func() map[K]A,
+	func()) {
+
+	options = append(options[:len(options):len(options)], withStageCounts(mapperCount, partitionerCount, reducerCount))
+	n, err := newNetwork(mapper, reducer, newConfig(options))
+	if err != nil {
+		panic(err)
+	}
+	return n.mapFunc, n.query, n.queryAll, n.shutdown
+}
+
+// Setup sets-up all the channels required to build the map-reduce network for
+// counting words, and creates all the functions required to interact with it.
+// It is the same as calling SetupMapReduce with CountWords and Sum, or with
+// CountTokens and Sum if a Tokenizer is set by WithTokenizer.
+// It is kept for compatibility: Setup is a thin wrapper of NewNetwork, which
+// returns a Network with more methods.
+//
+// The return values are:
+// (1) the "map" function which accepts a key (line number) and a value (line);
+// (2) the "query" function which accepts a keyword and returns its count;
+// (3) the "queryAll" function which returns the whole dictionary by gathering
+//     the local dictionaries from all reducers;
+// Both "query" and "queryAll" wait until every line passed to "map" before the
+// call has been counted.
+// (4) the "shutdown" function which should be called to gracefully terminate
+//     the map-reduce network.
+// Setup panics if the counts or the options are invalid. NewNetwork returns an
+// error instead.
+func Setup(mapperCount, partitionerCount, reducerCount uint, options ...Option) (
+	func(uint, string),
+	func(string) uint,
+	func() map[string]uint,
+	func()) {
+
+	options = append(options[:len(options):len(options)], withStageCounts(mapperCount, partitionerCount, reducerCount))
+	network, err := NewNetwork(options...)
+	if err != nil {
+		panic(err)
+	}
+	return network.Map, network.Query, network.QueryAll, network.Close
 }
@@ -0,0 +1,347 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+///////////
+// Tests //
+///////////
+
+// TestCountWords checks the function CountWords() with predefined test cases.
+func TestCountWords(t *testing.T) {
+	cases := []struct {
+		line     string
+		expected []string
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"TCP", []string{"TCP"}},
+		{"  the TCP  three-way\thandshake ", []string{"the", "TCP", "three-way", "handshake"}},
+	}
+	for _, c := range cases {
+		var got []string
+		CountWords(0, c.line, func(word string, count uint) {
+			if count != 1 {
+				t.Errorf("CountWords(%q) emitted %q with count %d, expected 1", c.line, word, count)
+			}
+			got = append(got, word)
+		})
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("CountWords(%q) emitted %q, expected %q", c.line, got, c.expected)
+		}
+	}
+}
+
+// TestReducerRoutine checks the function reducerRoutine() with reducers other
+// than Sum, by talking to it through its channel directly.
+func TestReducerRoutine(t *testing.T) {
+	syncChannel := make(chan bool)
+	report := func(err error) {
+		t.Errorf("reducerRoutine() reported %v", err)
+	}
+
+	// max-per-key
+	maxChannel := make(chan message[string, int, int])
+	go reducerRoutine(func(acc, value int) int {
+		return max(acc, value)
+	}, nil, maxChannel, syncChannel, report)
+	for _, v := range []int{3, 9, 4} {
+		maxChannel <- message[string, int, int]{Type: MAP, key: "a", value: v}
+	}
+	replyChannel := make(chan result[string, int])
+	maxChannel <- message[string, int, int]{Type: QUERY, key: "a", replyChannel: replyChannel}
+	if got := <-replyChannel; got.value != 9 {
+		t.Errorf("max of [3 9 4] = %d, expected 9", got.value)
+	}
+	close(maxChannel)
+	<-syncChannel
+
+	// distinct sets
+	setChannel := make(chan message[string, string, map[string]bool])
+	go reducerRoutine(func(acc map[string]bool, value string) map[string]bool {
+		if acc == nil {
+			acc = make(map[string]bool)
+		}
+		acc[value] = true
+		return acc
+	}, nil, setChannel, syncChannel, report)
+	for _, v := range []string{"x", "y", "x"} {
+		setChannel <- message[string, string, map[string]bool]{Type: MAP, key: "a", value: v}
+	}
+	setChannel <- message[string, string, map[string]bool]{Type: MAP, key: "b", value: "z"}
+	setReplyChannel := make(chan result[string, map[string]bool])
+	setChannel <- message[string, string, map[string]bool]{Type: QUERY_ALL, replyChannel: setReplyChannel}
+	got := make(map[string]map[string]bool)
+	for res := <-setReplyChannel; !res.done; res = <-setReplyChannel {
+		got[res.key] = res.value
+	}
+	expected := map[string]map[string]bool{
+		"a": {"x": true, "y": true},
+		"b": {"z": true},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("distinct sets = %v, expected %v", got, expected)
+	}
+	close(setChannel)
+	<-syncChannel
+}
+
+// TestSetupMapReduce checks the values returned by a map-reduce network with
+// a Mapper and a Reducer other than CountWords and Sum, which sums the even
+// and the odd numbers separately.
+func TestSetupMapReduce(t *testing.T) {
+	mapFunc, query, queryAll, shutdown := SetupMapReduce(2, 2, 3,
+		func(lineNo uint, n int, emit func(bool, int)) {
+			emit(n%2 == 0, n)
+		},
+		Sum[int])
+	defer shutdown()
+	for i := 0; i < 10; i++ {
+		mapFunc(uint(i), i)
+	}
+
+	expected := map[bool]int{true: 20, false: 25}
+	for key, value := range expected {
+		if got := query(key); got != value {
+			t.Errorf("query(%t) = %d, expected %d", key, got, value)
+		}
+	}
+	if got := queryAll(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("queryAll() = %v, expected %v", got, expected)
+	}
+}
+
+// TestSetup checks that the counts returned by the functions returned by
+// Setup() do not depend on the number of mappers, partitioners and reducers.
+func TestSetup(t *testing.T) {
+	lines := make([]string, 200)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("TCP handshake %d TCP", i%7)
+	}
+	cases := []struct {
+		mapperCount      uint
+		partitionerCount uint
+		reducerCount     uint
+	}{
+		{1, 1, 1},
+		{4, 1, 4},
+		{3, 2, 4},
+		{8, 8, 1},
+		{1, 5, 7},
+	}
+	for _, c := range cases {
+		mapFunc, query, queryAll, shutdown := Setup(c.mapperCount, c.partitionerCount, c.reducerCount)
+		for lineNo, line := range lines {
+			mapFunc(uint(lineNo), line)
+		}
+		if got := query("TCP"); got != 400 {
+			t.Errorf("Setup(%d, %d, %d): query(%q) = %d, expected 400", c.mapperCount, c.partitionerCount, c.reducerCount, "TCP", got)
+		}
+		dictionary := queryAll()
+		if len(dictionary) != 9 || dictionary["handshake"] != 200 || dictionary["6"] != 28 {
+			t.Errorf("Setup(%d, %d, %d): queryAll() = %v", c.mapperCount, c.partitionerCount, c.reducerCount, dictionary)
+		}
+		mapFunc(uint(len(lines)), "TCP")
+		if got := query("TCP"); got != 401 {
+			t.Errorf("Setup(%d, %d, %d): query(%q) = %d after one more line, expected 401", c.mapperCount, c.partitionerCount, c.reducerCount, "TCP", got)
+		}
+		shutdown()
+	}
+}
+
+// TestWithCombiner checks that the values are combined by the mappers when
+// WithCombiner() is used, and that the counts are not affected.
+func TestWithCombiner(t *testing.T) {
+	// The accumulated value is the sum and the number of messages reduced.
+	type sumAndCalls struct {
+		sum   uint
+		calls uint
+	}
+	reducer := func(acc sumAndCalls, value uint) sumAndCalls {
+		return sumAndCalls{acc.sum + value, acc.calls + 1}
+	}
+	cases := []struct {
+		options       []Option
+		expectedCalls uint
+	}{
+		{nil, 40},
+		{[]Option{WithCombiner(Sum[uint], 0)}, 10},
+		{[]Option{WithCombiner(Sum[uint], 1)}, 10},
+		{[]Option{WithCombiner(Sum[uint], 3)}, 4},
+		{[]Option{WithCombiner(Sum[uint], 10)}, 1},
+		{[]Option{WithCombiner(Sum[uint], 100)}, 1},
+	}
+	for _, c := range cases {
+		mapFunc, query, _, shutdown := SetupMapReduce(1, 2, 2, CountWords, reducer, c.options...)
+		for lineNo := uint(0); lineNo < 10; lineNo++ {
+			mapFunc(lineNo, "a a b a a")
+		}
+		if got := query("a"); got.sum != 40 || got.calls != c.expectedCalls {
+			t.Errorf("query(%q) = %+v, expected {sum:40 calls:%d}", "a", got, c.expectedCalls)
+		}
+		shutdown()
+	}
+
+	mapFunc, query, _, shutdown := Setup(4, 2, 3, WithCombiner(Sum[uint], 7))
+	for lineNo := uint(0); lineNo < 100; lineNo++ {
+		mapFunc(lineNo, "TCP a TCP")
+	}
+	if got := query("TCP"); got != 200 {
+		t.Errorf("query(%q) = %d, expected 200", "TCP", got)
+	}
+	shutdown()
+}
+
+// TestWithBatching checks that the counts are not affected when the stages
+// exchange batches, and that a batch which is not full is sent after its
+// latency.
+func TestWithBatching(t *testing.T) {
+	cases := []struct {
+		size    uint
+		latency time.Duration
+	}{
+		{0, 0},
+		{1, 0},
+		{2, 0},
+		{7, time.Millisecond},
+		{100, 0},
+		{100, time.Hour},
+	}
+	for _, c := range cases {
+		network := newTestNetwork(t, 3, 2, 4, WithBatching(c.size, c.latency))
+		for lineNo := uint(0); lineNo < 100; lineNo++ {
+			network.Map(lineNo, fmt.Sprintf("TCP w%d TCP", lineNo%9))
+		}
+		if got := network.Query("TCP"); got != 200 {
+			t.Errorf("WithBatching(%d, %v): Query(%q) = %d, expected 200", c.size, c.latency, "TCP", got)
+		}
+		if got := network.DistinctCount(); got != 10 {
+			t.Errorf("WithBatching(%d, %v): DistinctCount() = %d, expected 10", c.size, c.latency, got)
+		}
+		if err := network.ScaleReducers(2); err != nil {
+			t.Errorf("WithBatching(%d, %v): ScaleReducers(2) returned %v", c.size, c.latency, err)
+		}
+		network.Map(100, "TCP")
+		if got := network.Query("TCP"); got != 201 {
+			t.Errorf("WithBatching(%d, %v): Query(%q) = %d, expected 201", c.size, c.latency, "TCP", got)
+		}
+		network.Close()
+	}
+
+	// Stats does not wait for the lines, so the words are only routed once
+	// the batch is sent after its latency.
+	network := newTestNetwork(t, 1, 1, 1, WithBatching(100, 10*time.Millisecond))
+	defer network.Close()
+	network.Map(0, "TCP UDP")
+	deadline := time.Now().Add(5 * time.Second)
+	for network.Stats().Routed[0] != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Stats().Routed = %v after 5s, expected [2]", network.Stats().Routed)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestVisitKey checks that a keyed VISIT is made once, by the reducer keeping
+// the key only, and after the lines mapped before it are counted.
+func TestVisitKey(t *testing.T) {
+	network := newTestNetwork(t, 2, 2, 3)
+	defer network.Close()
+	for lineNo := uint(0); lineNo < 30; lineNo++ {
+		network.Map(lineNo, fmt.Sprintf("TCP w%d", lineNo))
+	}
+	network.Flush()
+	before := network.Stats().Routed
+	calls, count := 0, uint(0)
+	network.n.visitKey("TCP", func(dictionary map[string]uint) {
+		calls++
+		count = dictionary["TCP"]
+	})
+	if calls != 1 || count != 30 {
+		t.Errorf("visitKey(%q) made %d calls with a count of %d, expected 1 call with 30", "TCP", calls, count)
+	}
+	visited := 0
+	for i, routed := range network.Stats().Routed {
+		if routed != before[i] {
+			visited++
+		}
+	}
+	if visited != 1 {
+		t.Errorf("visitKey(%q) is routed to %d reducers, expected 1", "TCP", visited)
+	}
+}
+
+////////////////
+// Benchmarks //
+////////////////
+
+// benchmarkLines are the lines of input.txt, repeated 20 times.
+var benchmarkLines []string
+
+func init() {
+	content, err := os.ReadFile("../input.txt")
+	if err != nil {
+		panic(err)
+	}
+	lines := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	for i := 0; i < 20; i++ {
+		benchmarkLines = append(benchmarkLines, lines...)
+	}
+}
+
+// benchmarkTransport is a skeleton for benchmarking the transport between the
+// stages, by counting benchmarkLines with 4 mappers, 1 partitioner and 4
+// reducers, which is the setting of the example in README.md. Only the
+// words, not the lines, are batched, so a line still costs one message.
+// BenchmarkTransport1 	      14	  76961862 ns/op	   3.92 MB/s
+// BenchmarkTransport2 	      21	  50374563 ns/op	   6.00 MB/s
+// BenchmarkTransport3 	      26	  39506636 ns/op	   7.64 MB/s    <- Selected for -batch
+// BenchmarkTransport4 	      31	  39670397 ns/op	   7.61 MB/s
+// BenchmarkTransport5 	      46	  36982115 ns/op	   8.17 MB/s    <- With -buffer 16
+func benchmarkTransport(b *testing.B, options ...Option) {
+	options = append(options, WithMappers(4), WithPartitioners(1), WithReducers(4))
+	network, err := NewNetwork(options...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer network.Close()
+	size := 0
+	for _, line := range benchmarkLines {
+		size += len(line) + 1
+	}
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for lineNo, line := range benchmarkLines {
+			network.Map(uint(lineNo), line)
+		}
+		network.Flush()
+	}
+}
+
+// BenchmarkTransport1 sends one message per word (reference implementation).
+func BenchmarkTransport1(b *testing.B) {
+	benchmarkTransport(b)
+}
+
+func BenchmarkTransport2(b *testing.B) {
+	benchmarkTransport(b, WithBatching(16, 0))
+}
+
+func BenchmarkTransport3(b *testing.B) {
+	benchmarkTransport(b, WithBatching(64, 0))
+}
+
+func BenchmarkTransport4(b *testing.B) {
+	benchmarkTransport(b, WithBatching(256, 0))
+}
+
+func BenchmarkTransport5(b *testing.B) {
+	benchmarkTransport(b, WithBatching(64, 0), WithBufferSize(16))
+}
@@ -0,0 +1,161 @@
+package lib
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// The counters struct holds the counters of a network which are not kept by
+// a stage (see routingTable for the messages routed to each reducer).
+// "lines" is the number of records passed to mapFunc.
+// "tokens" is the number of key-value pairs emitted by the Mapper.
+// "queries" is the number of queries answered, including the visits.
+type counters struct {
+	lines   atomic.Uint64
+	tokens  atomic.Uint64
+	queries atomic.Uint64
+}
+
+// newCounters returns count new counters.
+func newCounters(count int) []*atomic.Uint64 {
+	routed := make([]*atomic.Uint64, count)
+	for i := range routed {
+		routed[i] = new(atomic.Uint64)
+	}
+	return routed
+}
+
+// The Stats struct is a snapshot of the state of a Network, returned by
+// Network.Stats.
+// "Mappers", "Partitioners" and "Reducers" are the numbers of the goroutines
+// of each stage. "Reducers" changes when the reducers are scaled.
+// "BufferSize" is the capacity of the channels between the stages.
+// "Remote" is true if the reducers are in worker processes.
+// "Lines" is the number of lines passed to Map.
+// "Tokens" is the number of words emitted by the mappers, before they are
+// combined (see WithCombiner).
+// "Queries" is the number of queries answered.
+// "Errors" is the number of errors reported by the stage goroutines.
+// "Routed" is the number of messages (words and queries) routed to each
+// reducer by the partitioners. A reducer receiving much more than the others
+// tells a skew of the Partitioner. It is restarted from 0 for a reducer added
+// by ScaleReducers.
+// "MapperQueues", "PartitionerQueue" and "ReducerQueues" are the numbers of
+// messages waiting in the channel of each mapper, the channel shared by the
+// partitioners, and the channel of each reducer. They are always 0 if the
+// channels are unbuffered (see WithBufferSize). A batch of words waiting in a
+// channel is counted as one message (see WithBatching).
+type Stats struct {
+	Mappers          uint
+	Partitioners     uint
+	Reducers         uint
+	BufferSize       uint
+	Remote           bool
+	Lines            uint64
+	Tokens           uint64
+	Queries          uint64
+	Errors           uint64
+	Routed           []uint64
+	MapperQueues     []int
+	PartitionerQueue int
+	ReducerQueues    []int
+}
+
+// stats returns a snapshot of the state of the network. Unlike the queries,
+// it does not wait for the records passed to mapFunc.
+func (n *network[R, K, V, A]) stats() Stats {
+	stats := Stats{
+		Mappers:          uint(len(n.mapperChannels)),
+		Partitioners:     n.partitionerCount,
+		BufferSize:       n.bufferSize,
+		Remote:           n.remote,
+		Lines:            n.counters.lines.Load(),
+		Tokens:           n.counters.tokens.Load(),
+		Queries:          n.counters.queries.Load(),
+		Errors:           n.errors.errorCount(),
+		MapperQueues:     make([]int, len(n.mapperChannels)),
+		PartitionerQueue: len(n.partitionerChannel),
+	}
+	for i, mc := range n.mapperChannels {
+		stats.MapperQueues[i] = len(mc)
+	}
+
+	n.routing.mutex.RLock()
+	defer n.routing.mutex.RUnlock()
+	stats.Reducers = uint(len(n.routing.reducerChannels))
+	stats.Routed = make([]uint64, len(n.routing.reducerChannels))
+	stats.ReducerQueues = make([]int, len(n.routing.reducerChannels))
+	for i, rc := range n.routing.reducerChannels {
+		stats.Routed[i] = n.routing.routed[i].Load()
+		stats.ReducerQueues[i] = len(rc)
+	}
+	return stats
+}
+
+// writePrometheus writes the stats to w in the Prometheus text exposition
+// format. All metrics are prefixed with "s2q1_".
+func writePrometheus(w io.Writer, stats Stats) error {
+	bw := bufio.NewWriter(w)
+	// metric writes the header of a metric.
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(bw, "# HELP s2q1_%s %s\n# TYPE s2q1_%s %s\n", name, help, name, kind)
+	}
+
+	metric("goroutines", "gauge", "Number of goroutines of each stage.")
+	fmt.Fprintf(bw, "s2q1_goroutines{stage=\"mapper\"} %d\n", stats.Mappers)
+	fmt.Fprintf(bw, "s2q1_goroutines{stage=\"partitioner\"} %d\n", stats.Partitioners)
+	fmt.Fprintf(bw, "s2q1_goroutines{stage=\"reducer\"} %d\n", stats.Reducers)
+
+	counters := []struct {
+		name, help string
+		value      uint64
+	}{
+		{"lines_total", "Lines passed to Map.", stats.Lines},
+		{"tokens_total", "Words emitted by the mappers.", stats.Tokens},
+		{"queries_total", "Queries answered.", stats.Queries},
+		{"errors_total", "Errors reported by the stages.", stats.Errors},
+	}
+	for _, c := range counters {
+		metric(c.name, "counter", c.help)
+		fmt.Fprintf(bw, "s2q1_%s %d\n", c.name, c.value)
+	}
+
+	metric("routed_messages_total", "counter", "Messages routed to each reducer by the partitioners.")
+	for i, routed := range stats.Routed {
+		fmt.Fprintf(bw, "s2q1_routed_messages_total{reducer=\"%d\"} %d\n", i, routed)
+	}
+
+	metric("queue_depth", "gauge", "Messages waiting in the channel of each stage.")
+	for i, depth := range stats.MapperQueues {
+		fmt.Fprintf(bw, "s2q1_queue_depth{stage=\"mapper\",channel=\"%d\"} %d\n", i, depth)
+	}
+	fmt.Fprintf(bw, "s2q1_queue_depth{stage=\"partitioner\",channel=\"0\"} %d\n", stats.PartitionerQueue)
+	for i, depth := range stats.ReducerQueues {
+		fmt.Fprintf(bw, "s2q1_queue_depth{stage=\"reducer\",channel=\"%d\"} %d\n", i, depth)
+	}
+	return bw.Flush()
+}
+
+// MetricsHandler returns an http.Handler which serves the Stats of the
+// network in the Prometheus text exposition format, to be scraped by
+// Prometheus or read by a human.
+func (nw *Network) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writePrometheus(w, nw.Stats())
+	})
+}
+
+// ExpvarFunc returns an expvar.Func which returns the Stats of the network, so
+// that they are served as JSON by the expvar package when published:
+//
+//	expvar.Publish("s2q1", network.ExpvarFunc())
+func (nw *Network) ExpvarFunc() expvar.Func {
+	return func() any {
+		return nw.Stats()
+	}
+}
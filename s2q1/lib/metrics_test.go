@@ -0,0 +1,131 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+///////////
+// Tests //
+///////////
+
+// TestWritePrometheus checks the function writePrometheus() with a predefined
+// Stats.
+func TestWritePrometheus(t *testing.T) {
+	stats := Stats{
+		Mappers:          2,
+		Partitioners:     1,
+		Reducers:         2,
+		Lines:            10,
+		Tokens:           30,
+		Queries:          4,
+		Errors:           1,
+		Routed:           []uint64{12, 20},
+		MapperQueues:     []int{0, 1},
+		PartitionerQueue: 2,
+		ReducerQueues:    []int{3, 0},
+	}
+	expected := `# HELP s2q1_goroutines Number of goroutines of each stage.
+# TYPE s2q1_goroutines gauge
+s2q1_goroutines{stage="mapper"} 2
+s2q1_goroutines{stage="partitioner"} 1
+s2q1_goroutines{stage="reducer"} 2
+# HELP s2q1_lines_total Lines passed to Map.
+# TYPE s2q1_lines_total counter
+s2q1_lines_total 10
+# HELP s2q1_tokens_total Words emitted by the mappers.
+# TYPE s2q1_tokens_total counter
+s2q1_tokens_total 30
+# HELP s2q1_queries_total Queries answered.
+# TYPE s2q1_queries_total counter
+s2q1_queries_total 4
+# HELP s2q1_errors_total Errors reported by the stages.
+# TYPE s2q1_errors_total counter
+s2q1_errors_total 1
+# HELP s2q1_routed_messages_total Messages routed to each reducer by the partitioners.
+# TYPE s2q1_routed_messages_total counter
+s2q1_routed_messages_total{reducer="0"} 12
+s2q1_routed_messages_total{reducer="1"} 20
+# HELP s2q1_queue_depth Messages waiting in the channel of each stage.
+# TYPE s2q1_queue_depth gauge
+s2q1_queue_depth{stage="mapper",channel="0"} 0
+s2q1_queue_depth{stage="mapper",channel="1"} 1
+s2q1_queue_depth{stage="partitioner",channel="0"} 2
+s2q1_queue_depth{stage="reducer",channel="0"} 3
+s2q1_queue_depth{stage="reducer",channel="1"} 0
+`
+	var buffer bytes.Buffer
+	if err := writePrometheus(&buffer, stats); err != nil {
+		t.Fatalf("writePrometheus() = %v", err)
+	}
+	if got := buffer.String(); got != expected {
+		t.Errorf("writePrometheus() wrote\n%s\nexpected\n%s", got, expected)
+	}
+}
+
+// TestMetrics checks the counters of a running network, and that they are
+// served by MetricsHandler() and ExpvarFunc().
+func TestMetrics(t *testing.T) {
+	// All words go to reducer 0 except "z", to make a skew.
+	network := newTestNetwork(t, 2, 1, 2, WithPartitioner(RangePartitioner{Bounds: []string{"z"}}))
+	defer network.Close()
+	for lineNo := uint(0); lineNo < 10; lineNo++ {
+		network.Map(lineNo, "a b z")
+	}
+	network.Query("a")
+	network.TopK(1)
+
+	stats := network.Stats()
+	if stats.Lines != 10 || stats.Tokens != 30 || stats.Queries != 2 {
+		t.Errorf("Stats() = %+v, expected 10 lines, 30 tokens and 2 queries", stats)
+	}
+	// The query for "a" is routed too.
+	if len(stats.Routed) != 2 || stats.Routed[0] != 21 || stats.Routed[1] != 10 {
+		t.Errorf("Stats().Routed = %v, expected [21 10]", stats.Routed)
+	}
+
+	recorder := httptest.NewRecorder()
+	network.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if body := recorder.Body.String(); !strings.Contains(body, `s2q1_routed_messages_total{reducer="0"} 21`) {
+		t.Errorf("MetricsHandler() served\n%s", body)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain") {
+		t.Errorf("MetricsHandler() served Content-Type %q", contentType)
+	}
+
+	var decoded Stats
+	if err := json.Unmarshal([]byte(network.ExpvarFunc().String()), &decoded); err != nil || decoded.Lines != 10 {
+		t.Errorf("ExpvarFunc() = %s, %v", network.ExpvarFunc().String(), err)
+	}
+}
+
+// TestQueueDepth checks that the messages waiting behind a busy stage are
+// counted in Stats().
+func TestQueueDepth(t *testing.T) {
+	gate := make(chan bool)
+	partitioner := PartitionerFunc(func(key string, reducerCount int) int {
+		if key == "busy" {
+			<-gate
+		}
+		return 0
+	})
+	network := newTestNetwork(t, 1, 1, 1, WithPartitioner(partitioner), WithBufferSize(8))
+	defer network.Close()
+	network.Map(0, "busy a b c")
+
+	deadline := time.Now().Add(time.Second)
+	for network.Stats().PartitionerQueue != 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := network.Stats().PartitionerQueue; got != 3 {
+		t.Errorf("Stats().PartitionerQueue = %d, expected 3", got)
+	}
+	close(gate)
+	if got := network.Query("a"); got != 1 {
+		t.Errorf("Query(%q) = %d, expected 1", "a", got)
+	}
+}
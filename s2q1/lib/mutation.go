@@ -0,0 +1,72 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+)
+
+// addDelta adds a signed delta to an accumulated value, and returns the sum
+// and whether it is zero. Only the values of the integer types uint and int
+// (such as the counts of Sum[uint]) could be added to. A uint never goes
+// below zero: a delta larger than the value makes it zero. For the other
+// types, it returns a non-nil error.
+func addDelta[A any](acc A, delta int64) (A, bool, error) {
+	var sum any
+	switch v := any(acc).(type) {
+	case uint:
+		if delta < 0 {
+			v -= min(v, uint(-delta))
+		} else {
+			v += uint(delta)
+		}
+		sum = v
+	case int:
+		sum = v + int(delta)
+	default:
+		return acc, false, fmt.Errorf("A delta could not be added to %T", acc)
+	}
+	var zero A
+	return sum.(A), sum == any(zero), nil
+}
+
+// add adds the deltas to the values of their keys, by sending an ADD for each
+// of them to the partitioners, and returns after the reducers have added all
+// of them. The records passed to mapFunc before the call are all counted
+// before the deltas are added, and the records passed after the call are
+// counted after, even if they go through another partitioner.
+func (n *network[R, K, V, A]) add(deltas ...pair[K, int64]) {
+	n.flush()
+
+	// The reply channel holds all replies, so that a reducer does not wait
+	// for the caller, which may still be sending the other deltas.
+	replyChannel := make(chan result[K, A], len(deltas))
+	for _, d := range deltas {
+		n.partitionerChannel <- message[K, V, A]{Type: ADD, key: d.key, delta: d.value, replyChannel: replyChannel}
+	}
+	for range deltas {
+		<-replyChannel
+	}
+}
+
+// deleteKey removes a key from the dictionary, by sending a DELETE to the
+// partitioners, and returns after the reducer has removed it. Like add, the
+// records passed to mapFunc before the call are all counted before the key
+// is removed, and the records passed after the call are counted after.
+func (n *network[R, K, V, A]) deleteKey(key K) {
+	n.flush()
+
+	replyChannel := make(chan result[K, A])
+	n.partitionerChannel <- message[K, V, A]{Type: DELETE, key: key, replyChannel: replyChannel}
+	<-replyChannel
+}
+
+// reset removes all keys from the dictionaries of all reducers, and returns
+// after all reducers have cleared their dictionaries. The records passed to
+// mapFunc before the call are all counted, and then removed.
+func (n *network[R, K, V, A]) reset() {
+	n.flush()
+
+	replyChannel := make(chan result[K, A])
+	n.partitionerChannel <- message[K, V, A]{Type: RESET, replyChannel: replyChannel}
+	receiveAll(context.Background(), replyChannel, func(result[K, A]) {})
+}
@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+///////////
+// Tests //
+///////////
+
+// TestAddDelta checks the function addDelta() with predefined test cases.
+func TestAddDelta(t *testing.T) {
+	uintCases := []struct {
+		acc      uint
+		delta    int64
+		expected uint
+	}{
+		{0, 0, 0},
+		{0, 3, 3},
+		{5, 3, 8},
+		{5, -3, 2},
+		{5, -5, 0},
+		{5, -9, 0},
+	}
+	for _, c := range uintCases {
+		got, zero, err := addDelta(c.acc, c.delta)
+		if got != c.expected || zero != (c.expected == 0) || err != nil {
+			t.Errorf("addDelta(%d, %d) = (%d, %t, %v), expected (%d, %t, nil)", c.acc, c.delta, got, zero, err, c.expected, c.expected == 0)
+		}
+	}
+	if got, zero, err := addDelta(5, -9); got != -4 || zero || err != nil {
+		t.Errorf("addDelta(5, -9) = (%d, %t, %v), expected (-4, false, nil)", got, zero, err)
+	}
+	if _, _, err := addDelta([]Posting{}, 1); err == nil {
+		t.Errorf("addDelta([]Posting{}, 1) returned a nil error")
+	}
+}
+
+// TestMutations checks Add, Delete, Unmap and Reset of networks with the
+// reducers in memory, spilling to disk, and in worker "processes", against
+// the counts expected.
+func TestMutations(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() = %v", err)
+	}
+	defer listener.Close()
+	go ServeReducer(listener)
+
+	cases := []struct {
+		name    string
+		options []Option
+	}{
+		{"memory", nil},
+		{"batching", []Option{WithBatching(16, 0)}},
+		{"spill", []Option{WithSpill(1000, t.TempDir())}},
+		{"remote", []Option{WithRemoteReducers(listener.Addr().String())}},
+	}
+	for _, c := range cases {
+		network := newTestNetwork(t, 2, 2, 3, c.options...)
+		for lineNo := uint(0); lineNo < 300; lineNo++ {
+			network.Map(lineNo, fmt.Sprintf("TCP w%d UDP", lineNo))
+		}
+		network.Add("TCP", 5)
+		network.Add("UDP", -100)
+		network.Add("w7", -1)
+		network.Add("new", 2)
+		network.Delete("w8")
+		network.Unmap(0, "TCP w0 TCP")
+		expected := map[string]uint{"TCP": 303, "UDP": 200, "w7": 0, "w8": 0, "w0": 0, "w9": 1, "new": 2}
+		for word, count := range expected {
+			if got := network.Query(word); got != count {
+				t.Errorf("%s: Query(%q) = %d, expected %d", c.name, word, got, count)
+			}
+		}
+		if got := network.DistinctCount(); got != 300 {
+			t.Errorf("%s: DistinctCount() = %d, expected 300", c.name, got)
+		}
+		if _, ok := network.QueryAll()["w7"]; ok {
+			t.Errorf("%s: QueryAll() has %q with a count of 0", c.name, "w7")
+		}
+
+		network.Reset()
+		if got := network.QueryAll(); len(got) != 0 {
+			t.Errorf("%s: QueryAll() has %d words after Reset(), expected none", c.name, len(got))
+		}
+		network.Map(300, "TCP TCP")
+		if got := network.QueryAll(); !reflect.DeepEqual(got, map[string]uint{"TCP": 2}) {
+			t.Errorf("%s: QueryAll() = %v after Reset(), expected map[TCP:2]", c.name, got)
+		}
+		if err := network.Err(); err != nil {
+			t.Errorf("%s: Err() = %v, expected nil", c.name, err)
+		}
+		network.Close()
+	}
+
+	approximate := newTestNetwork(t, 1, 1, 1, WithApproximation(0.001, 0.01, 0.02))
+	defer approximate.Close()
+	approximate.Map(0, "TCP")
+	if err := approximate.Add("TCP", 1); err == nil {
+		t.Errorf("Add() returned a nil error when the counting is approximate")
+	}
+	if err := approximate.Delete("TCP"); err == nil {
+		t.Errorf("Delete() returned a nil error when the counting is approximate")
+	}
+	if err := approximate.Unmap(0, "TCP"); err == nil {
+		t.Errorf("Unmap() returned a nil error when the counting is approximate")
+	}
+	approximate.Reset()
+	if got := approximate.Query("TCP"); got != 0 {
+		t.Errorf("Query(%q) = %d after Reset(), expected 0", "TCP", got)
+	}
+}
+
+// TestMutationOrder checks that the lines mapped right after Add or Delete are
+// counted after the change, even if they go through another partitioner,
+// which is slowed down by a random delay.
+func TestMutationOrder(t *testing.T) {
+	partitioner := PartitionerFunc(func(key string, reducerCount int) int {
+		time.Sleep(time.Duration(rand.IntN(100)) * time.Microsecond)
+		return 0
+	})
+	network := newTestNetwork(t, 4, 8, 2, WithPartitioner(partitioner))
+	defer network.Close()
+	for i := uint(0); i < 50; i++ {
+		network.Map(4*i, "TCP TCP")
+		network.Delete("TCP")
+		network.Map(4*i+1, "TCP")
+		network.Add("TCP", 2)
+		network.Map(4*i+2, "TCP")
+		network.Add("TCP", -4)
+		network.Map(4*i+3, "TCP")
+		if got := network.Query("TCP"); got != 1 {
+			t.Fatalf("Query(%q) = %d in round %d, expected 1", "TCP", got, i)
+		}
+	}
+}
+
+// TestAddUnsupported checks that adding a delta to a value which is not an
+// integer is reported as a StageError, without changing the value.
+func TestAddUnsupported(t *testing.T) {
+	n, err := newNetwork(IndexWords, AppendPosting, newConfig([]Option{withStageCounts(1, 1, 1)}))
+	if err != nil {
+		t.Fatalf("newNetwork() returned %v", err)
+	}
+	defer n.shutdown()
+	n.mapFunc(0, "TCP")
+	n.add(pair[string, int64]{"TCP", 1})
+	if got := n.query("TCP"); len(got) != 1 {
+		t.Errorf("query(%q) = %v, expected 1 posting", "TCP", got)
+	}
+	if n.errors.err() == nil {
+		t.Errorf("Adding a delta to the postings is not reported")
+	}
+}
@@ -0,0 +1,273 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+)
+
+// The Network struct is a running map-reduce network for counting words,
+// created by NewNetwork. Its methods could be called by many goroutines
+// concurrently. It must not be used after Close is called.
+//
+// All queries wait until every line passed to Map before the call has been
+// counted, so the results do not depend on the number of goroutines of each
+// stage. "TopK", "Prefix" and "CountRange" are answered by each reducer with
+// its local dictionary, and only the partial answers are merged, so the whole
+// dictionary is never gathered.
+//
+// Map, Query, QueryAll, Flush and Close block until the stages of the network
+// accept the request. Their variants with a context.Context, such as
+// MapContext, give up when the context is done instead, so that a stuck stage
+// does not hang the caller.
+type Network struct {
+	n         *network[string, string, uint, uint]
+	mapper    Mapper[string, string, uint]
+	tokenizer Tokenizer
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewNetwork sets-up all the channels and goroutines of a map-reduce network
+// for counting words, with the words split by the Tokenizer set by
+// WithTokenizer, and the n-grams set by WithNGrams. The numbers of the
+// goroutines of each stage are set by WithMappers, WithPartitioners and
+// WithReducers.
+// If NewNetwork succeeds, it returns the Network and a nil error;
+// Otherwise (for example, if any count is 0, or the remote reducers could not
+// be connected), it returns nil and a non-nil error.
+func NewNetwork(options ...Option) (*Network, error) {
+	c := newConfig(options)
+	mapper := CountNGrams(c.tokenizer, c.ngrams)
+	n, err := newNetwork(mapper, Sum[uint], c)
+	if err != nil {
+		return nil, err
+	}
+	return &Network{n: n, mapper: mapper, tokenizer: c.tokenizer}, nil
+}
+
+// Map sends a line to one of the mappers in a round-robin manner, where it
+// is split into words to be counted. "lineNo" is the key (line number) of the
+// line.
+func (nw *Network) Map(lineNo uint, line string) {
+	nw.n.mapFunc(lineNo, line)
+}
+
+// MapContext is the same as Map, except that it returns the error of ctx if
+// ctx is done before a mapper receives the line. The line is then not counted.
+func (nw *Network) MapContext(ctx context.Context, lineNo uint, line string) error {
+	return nw.n.mapContext(ctx, lineNo, line)
+}
+
+// Query returns the count of a word. It is an estimate, which is never less
+// than the true count, if the counting is approximate (see WithApproximation).
+func (nw *Network) Query(word string) uint {
+	return nw.n.query(word)
+}
+
+// QueryContext is the same as Query, except that it returns 0 and the error of
+// ctx if ctx is done before the count is received.
+func (nw *Network) QueryContext(ctx context.Context, word string) (uint, error) {
+	return nw.n.queryContext(ctx, word)
+}
+
+// QueryAll returns the whole dictionary by gathering the local dictionaries
+// from all reducers.
+func (nw *Network) QueryAll() map[string]uint {
+	return nw.n.queryAll()
+}
+
+// QueryAllContext is the same as QueryAll, except that it returns nil and the
+// error of ctx if ctx is done before the whole dictionary is received.
+func (nw *Network) QueryAllContext(ctx context.Context) (map[string]uint, error) {
+	return nw.n.queryAllContext(ctx)
+}
+
+// Flush blocks until every line passed to Map before the call has been
+// counted. It is not needed before a query, which flushes by itself.
+func (nw *Network) Flush() {
+	nw.n.flush()
+}
+
+// FlushContext is the same as Flush, except that it returns the error of ctx
+// if ctx is done before the lines are counted.
+func (nw *Network) FlushContext(ctx context.Context) error {
+	return nw.n.flushContext(ctx)
+}
+
+// TopK returns the k words with the largest counts, in descending order of
+// count. Words with the same count are ordered by word.
+func (nw *Network) TopK(k uint) []WordCount {
+	// The top k words of the whole dictionary must be among the top k
+	// words of the local dictionary they belong to.
+	wcs := gather(nw.n, WordFilter{Kind: filterTopK, K: k})
+	slices.SortFunc(wcs, compareWordCounts)
+	return wcs[:min(k, uint(len(wcs)))]
+}
+
+// TopKNGrams is the same as TopK, except that only the n-grams of "size"
+// words are considered, so that TopKNGrams(k, 2) returns the k most frequent
+// bigrams when the words and the bigrams are both counted (see WithNGrams).
+func (nw *Network) TopKNGrams(k, size uint) []WordCount {
+	wcs := gather(nw.n, WordFilter{Kind: filterTopK, K: k, Size: size})
+	slices.SortFunc(wcs, compareWordCounts)
+	return wcs[:min(k, uint(len(wcs)))]
+}
+
+// Prefix returns the words starting with prefix, ordered by word.
+func (nw *Network) Prefix(prefix string) []WordCount {
+	wcs := gather(nw.n, WordFilter{Kind: filterPrefix, Prefix: prefix})
+	slices.SortFunc(wcs, compareWords)
+	return wcs
+}
+
+// CountRange returns the words whose count is in [a, b], ordered by word.
+func (nw *Network) CountRange(a, b uint) []WordCount {
+	wcs := gather(nw.n, WordFilter{Kind: filterCountRange, Min: a, Max: b})
+	slices.SortFunc(wcs, compareWords)
+	return wcs
+}
+
+// DistinctCount returns the number of distinct words. It is an estimate if
+// the counting is approximate (see WithApproximation).
+func (nw *Network) DistinctCount() uint {
+	return nw.n.distinctCount()
+}
+
+// ScaleReducers changes the number of reducers, moving the words to their new
+// reducers. Mapping and queries may go on while it runs, and the counts are
+// not affected. It returns a non-nil error if the number is 0, if the
+// reducers are remote or approximate, or if the Partitioner fails on a word
+// under the new number. The reducers are then left unchanged.
+func (nw *Network) ScaleReducers(reducerCount uint) error {
+	return nw.n.scaleReducers(reducerCount)
+}
+
+// Add adds a signed delta to the count of a word, such as a correction. A
+// count never goes below zero, and a word whose count becomes zero is removed,
+// as if it is never counted. The lines passed to Map before the call are all
+// counted before the delta is added. It returns a non-nil error if the
+// counting is approximate.
+func (nw *Network) Add(word string, delta int) error {
+	if nw.n.approximate {
+		return fmt.Errorf("Approximate counts could not be changed")
+	}
+	nw.n.add(pair[string, int64]{word, int64(delta)})
+	return nil
+}
+
+// Delete removes a word, as if it is never counted. The lines passed to Map
+// before the call are all counted before the word is removed. It returns a
+// non-nil error if the counting is approximate.
+func (nw *Network) Delete(word string) error {
+	if nw.n.approximate {
+		return fmt.Errorf("Approximate counts could not be changed")
+	}
+	nw.n.deleteKey(word)
+	return nil
+}
+
+// Reset removes all words, including the counts of the lines passed to Map
+// before the call, so that the network could count a new input from scratch.
+func (nw *Network) Reset() {
+	nw.n.reset()
+}
+
+// Unmap subtracts the counts of the words of a line passed to Map before,
+// such as a line of a retracted document, so that the counts are the same as
+// if the line is never mapped. The line is split into words in the caller's
+// goroutine in the same way as Map. It returns a non-nil error if the counting
+// is approximate.
+func (nw *Network) Unmap(lineNo uint, line string) error {
+	if nw.n.approximate {
+		return fmt.Errorf("Approximate counts could not be changed")
+	}
+	counts := make(map[string]int64)
+	var order []string
+	protect("mapper", lineInput(lineNo), nw.n.errors.report, func() {
+		nw.mapper(lineNo, line, func(word string, count uint) {
+			if _, ok := counts[word]; !ok {
+				order = append(order, word)
+			}
+			counts[word] -= int64(count)
+		})
+	})
+	deltas := make([]pair[string, int64], len(order))
+	for i, word := range order {
+		deltas[i] = pair[string, int64]{word, counts[word]}
+	}
+	nw.n.add(deltas...)
+	return nil
+}
+
+// Watch subscribes to the changes of the counts of the words described by w,
+// instead of polling Query. An update, the word and its new count, is sent to
+// "updates" when a count changes (or crosses "Threshold", see Watch). The
+// lines passed to Map before the call are all counted before the watch
+// starts. It returns the function canceling the subscription, which could be
+// called more than once. No update is sent after it returns, and "updates" is
+// never closed, since it belongs to the caller.
+//
+// An update is sent by the reducer keeping the word, which waits until the
+// update is received, so the updates of a word are in order and none is
+// lost, but a slow receiver holds up the counting. "updates" should be
+// buffered, and received by a goroutine which does not call Map or the
+// queries. The subscriptions are canceled when the network is closed. It
+// returns a non-nil error if the reducers are remote or approximate.
+func (nw *Network) Watch(w Watch, updates chan<- WordCount) (func(), error) {
+	if nw.n.remote {
+		return nil, fmt.Errorf("Remote reducers could not be watched")
+	}
+	if nw.n.approximate {
+		return nil, fmt.Errorf("Approximate counts could not be watched")
+	}
+	return watch(nw.n, w, updates), nil
+}
+
+// Snapshot writes the dictionaries of all reducers to w, in a versioned JSON
+// format.
+func (nw *Network) Snapshot(w io.Writer) error {
+	return writeSnapshot(nw.n, w)
+}
+
+// Restore reads a snapshot written by Snapshot from r, and adds the counts in
+// it to the network. The network may have a different number of reducers from
+// the one the snapshot is taken, and may already have counts, which are
+// merged with the snapshot.
+func (nw *Network) Restore(r io.Reader) error {
+	return readSnapshot(nw.n, r)
+}
+
+// Err returns the first error reported by the stage goroutines, such as a
+// StageError when the Partitioner panics, or nil if there is none. The
+// message causing an error is skipped, and the network goes on.
+func (nw *Network) Err() error {
+	return nw.n.errors.err()
+}
+
+// Stats returns a snapshot of the state of the network, including the
+// counters of each stage. Unlike the queries, it does not wait for the lines
+// passed to Map. MetricsHandler and ExpvarFunc serve it over HTTP.
+func (nw *Network) Stats() Stats {
+	return nw.n.stats()
+}
+
+// Close gracefully terminates the map-reduce network, after every line passed
+// to Map has been counted. Calling it more than once has no effect.
+func (nw *Network) Close() {
+	nw.CloseContext(context.Background())
+}
+
+// CloseContext is the same as Close, except that it returns a DrainError if
+// ctx is done before all the stages terminate. The DrainError tells which
+// stage fails to drain. A timeout is set with context.WithTimeout. The network
+// could not be closed again after CloseContext fails: calling Close or
+// CloseContext again returns the same error.
+func (nw *Network) CloseContext(ctx context.Context) error {
+	nw.closeOnce.Do(func() {
+		nw.closeErr = nw.n.shutdownContext(ctx)
+	})
+	return nw.closeErr
+}
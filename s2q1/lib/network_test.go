@@ -0,0 +1,229 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+///////////
+// Tests //
+///////////
+
+// newTestStages calls newFunc (such as NewNetwork or NewCorpus) with the
+// options and the stage counts, and fails the test if it returns an error.
+func newTestStages[T any](t *testing.T, newFunc func(...Option) (T, error), mapperCount, partitionerCount, reducerCount uint, options ...Option) T {
+	t.Helper()
+	options = append(options, WithMappers(mapperCount), WithPartitioners(partitionerCount), WithReducers(reducerCount))
+	stages, err := newFunc(options...)
+	if err != nil {
+		t.Fatalf("Creating a %T with %d, %d, %d goroutines returned %v", stages, mapperCount, partitionerCount, reducerCount, err)
+	}
+	return stages
+}
+
+// newTestNetwork calls NewNetwork with the stage counts, and fails the test if
+// it returns an error.
+func newTestNetwork(t *testing.T, mapperCount, partitionerCount, reducerCount uint, options ...Option) *Network {
+	t.Helper()
+	return newTestStages(t, NewNetwork, mapperCount, partitionerCount, reducerCount, options...)
+}
+
+// TestNewNetwork checks the counts and the Stats of networks with different
+// settings, including buffered channels.
+func TestNewNetwork(t *testing.T) {
+	cases := []struct {
+		mapperCount, partitionerCount, reducerCount, bufferSize uint
+	}{
+		{1, 1, 1, 0},
+		{4, 1, 4, 0},
+		{1, 1, 1, 16},
+		{3, 2, 5, 1},
+		{4, 4, 4, 1024},
+	}
+	for _, c := range cases {
+		network := newTestNetwork(t, c.mapperCount, c.partitionerCount, c.reducerCount, WithBufferSize(c.bufferSize))
+		for lineNo := uint(0); lineNo < 500; lineNo++ {
+			network.Map(lineNo, fmt.Sprintf("TCP w%d", lineNo%7))
+		}
+		network.Flush()
+		stats := network.Stats()
+		routed := uint64(0)
+		for _, r := range stats.Routed {
+			routed += r
+		}
+		if len(stats.Routed) != int(c.reducerCount) || routed != 1000 {
+			t.Errorf("Stats().Routed = %v, expected %d reducers and 1000 messages in total", stats.Routed, c.reducerCount)
+		}
+		if len(stats.MapperQueues) != int(c.mapperCount) || len(stats.ReducerQueues) != int(c.reducerCount) {
+			t.Errorf("Stats() has queue depths %v and %v", stats.MapperQueues, stats.ReducerQueues)
+		}
+		stats.Routed, stats.MapperQueues, stats.ReducerQueues = nil, nil, nil
+		expected := Stats{
+			Mappers:      c.mapperCount,
+			Partitioners: c.partitionerCount,
+			Reducers:     c.reducerCount,
+			BufferSize:   c.bufferSize,
+			Lines:        500,
+			Tokens:       1000,
+		}
+		if !reflect.DeepEqual(stats, expected) {
+			t.Errorf("Stats() = %+v, expected %+v", stats, expected)
+		}
+		if got := network.Query("TCP"); got != 500 {
+			t.Errorf("Query(%q) = %d with %+v, expected 500", "TCP", got, c)
+		}
+		if got := len(network.QueryAll()); got != 8 {
+			t.Errorf("QueryAll() has %d words with %+v, expected 8", got, c)
+		}
+		network.Close()
+		network.Close()
+	}
+}
+
+// TestNewNetworkDefaults checks that a network could be created without any
+// options.
+func TestNewNetworkDefaults(t *testing.T) {
+	network, err := NewNetwork()
+	if err != nil {
+		t.Fatalf("NewNetwork() returned %v", err)
+	}
+	defer network.Close()
+	network.Map(0, "TCP UDP TCP")
+	if got := network.Query("TCP"); got != 2 {
+		t.Errorf("Query(%q) = %d, expected 2", "TCP", got)
+	}
+	if stats := network.Stats(); stats.Mappers == 0 || stats.Partitioners != 1 || stats.Reducers == 0 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+}
+
+// TestContextCanceled checks that the context variants of the methods of
+// Network do nothing with a canceled context.
+func TestContextCanceled(t *testing.T) {
+	network := newTestNetwork(t, 2, 1, 2)
+	defer network.Close()
+	network.Map(0, "TCP")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := network.MapContext(ctx, 1, "TCP"); !errors.Is(err, context.Canceled) {
+		t.Errorf("MapContext() = %v, expected %v", err, context.Canceled)
+	}
+	if _, err := network.QueryContext(ctx, "TCP"); !errors.Is(err, context.Canceled) {
+		t.Errorf("QueryContext() returned %v, expected %v", err, context.Canceled)
+	}
+	if _, err := network.QueryAllContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("QueryAllContext() returned %v, expected %v", err, context.Canceled)
+	}
+	if err := network.FlushContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("FlushContext() = %v, expected %v", err, context.Canceled)
+	}
+	if got := network.Query("TCP"); got != 1 {
+		t.Errorf("Query(%q) = %d, expected 1", "TCP", got)
+	}
+	if got := network.Stats().Lines; got != 1 {
+		t.Errorf("Stats().Lines = %d, expected 1", got)
+	}
+}
+
+// TestContextStuck checks that the context variants of the methods of Network
+// give up when a stage is stuck, that the network works again when the stage
+// goes on, and that CloseContext tells the stage which fails to drain.
+func TestContextStuck(t *testing.T) {
+	gate := make(chan bool)
+	defer close(gate)
+	partitioner := PartitionerFunc(func(key string, reducerCount int) int {
+		if key == "stuck" {
+			<-gate
+		}
+		return 0
+	})
+	network := newTestNetwork(t, 1, 1, 1, WithPartitioner(partitioner))
+	timeout := func() (context.Context, context.CancelFunc) {
+		return context.WithTimeout(context.Background(), 50*time.Millisecond)
+	}
+
+	if err := network.MapContext(context.Background(), 0, "stuck TCP"); err != nil {
+		t.Fatalf("MapContext() = %v", err)
+	}
+	ctx, cancel := timeout()
+	if _, err := network.QueryContext(ctx, "TCP"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("QueryContext() returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+	cancel()
+	ctx, cancel = timeout()
+	if _, err := network.QueryAllContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("QueryAllContext() returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+	cancel()
+
+	gate <- true
+	if got := network.Query("TCP"); got != 1 {
+		t.Errorf("Query(%q) = %d, expected 1", "TCP", got)
+	}
+
+	network.Map(1, "stuck")
+	ctx, cancel = timeout()
+	defer cancel()
+	err := network.CloseContext(ctx)
+	var drainError *DrainError
+	if !errors.As(err, &drainError) || drainError.Stage != "partitioner" || drainError.Running != 1 {
+		t.Errorf("CloseContext() = %v, expected the partitioner stage not drained", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("CloseContext() = %v, expected to wrap %v", err, context.DeadlineExceeded)
+	}
+}
+
+// TestNetworkQueries checks the queries of Network against the answers
+// computed from the whole dictionary.
+func TestNetworkQueries(t *testing.T) {
+	network := newTestNetwork(t, 3, 2, 4)
+	defer network.Close()
+	for lineNo := uint(0); lineNo < 300; lineNo++ {
+		network.Map(lineNo, fmt.Sprintf("w%d w%d x%d TCP", lineNo%13, lineNo%5, lineNo%2))
+	}
+	dictionary := network.QueryAll()
+
+	var all []WordCount
+	for word, count := range dictionary {
+		all = append(all, WordCount{word, count})
+	}
+	slices.SortFunc(all, compareWordCounts)
+	for _, k := range []uint{0, 1, 4, 10, 100} {
+		got := network.TopK(k)
+		expected := all[:min(k, uint(len(all)))]
+		if !equalWordCounts(got, expected) {
+			t.Errorf("TopK(%d) = %v, expected %v", k, got, expected)
+		}
+	}
+
+	slices.SortFunc(all, compareWords)
+	for _, prefix := range []string{"", "w1", "x", "y"} {
+		var expected []WordCount
+		for _, wc := range all {
+			if len(wc.Word) >= len(prefix) && wc.Word[:len(prefix)] == prefix {
+				expected = append(expected, wc)
+			}
+		}
+		if got := network.Prefix(prefix); !equalWordCounts(got, expected) {
+			t.Errorf("Prefix(%q) = %v, expected %v", prefix, got, expected)
+		}
+	}
+	for _, r := range [][2]uint{{0, 0}, {23, 24}, {60, 150}, {300, 300}} {
+		var expected []WordCount
+		for _, wc := range all {
+			if r[0] <= wc.Count && wc.Count <= r[1] {
+				expected = append(expected, wc)
+			}
+		}
+		if got := network.CountRange(r[0], r[1]); !equalWordCounts(got, expected) {
+			t.Errorf("CountRange(%d, %d) = %v, expected %v", r[0], r[1], got, expected)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NGramSeparator is the separator between the words of an n-gram in its key.
+// The key of the bigram of "TCP" and "three-way" is "TCP three-way", so that
+// it is queried in the same way as it is written.
+const NGramSeparator = " "
+
+// The NGrams struct describes which n-grams (sequences of n words in a line)
+// are counted, instead of the words only. The zero value counts the words
+// only, the same as {Min: 1, Max: 1}.
+// "Min" and "Max" are the smallest and the largest numbers of words in an
+// n-gram. {Min: 1, Max: 2} counts the words and the bigrams, while
+// {Min: 2, Max: 2} counts the bigrams only. If "Min" is 0, it is treated as 1;
+// If "Max" is 0, it is treated as "Min".
+// "Skip" is the largest number of words skipped in an n-gram in total
+// (skip-grams). With {Min: 2, Max: 2, Skip: 1}, the line "a b c" has the
+// n-grams "a b", "a c" and "b c".
+//
+// The n-grams are made of the words emitted by the Tokenizer, so the words
+// dropped (such as the stop words) are neither counted nor skipped. An n-gram
+// never spans two lines.
+type NGrams struct {
+	Min  uint
+	Max  uint
+	Skip uint
+}
+
+// sizes returns the smallest and the largest numbers of words in an n-gram,
+// with the zero values replaced.
+func (g NGrams) sizes() (uint, uint) {
+	minSize := max(g.Min, 1)
+	maxSize := g.Max
+	if maxSize == 0 {
+		maxSize = minSize
+	}
+	return minSize, maxSize
+}
+
+// validate checks that "Max" is not less than "Min".
+func (g NGrams) validate() error {
+	if minSize, maxSize := g.sizes(); maxSize < minSize {
+		return fmt.Errorf("The largest n-gram size must not be less than the smallest one: %d < %d", maxSize, minSize)
+	}
+	return nil
+}
+
+// each calls emit once for each n-gram of the words, with its key.
+// The n-grams starting at a word are emitted before those starting at the
+// next word, and the shorter ones before the longer ones.
+func (g NGrams) each(words []string, emit func(key string)) {
+	minSize, maxSize := g.sizes()
+	picked := make([]string, 0, maxSize)
+	// extend appends the words after words[last] to picked, skipping at most
+	// "skip" words, until picked has maxSize words.
+	var extend func(last int, skip uint)
+	extend = func(last int, skip uint) {
+		if uint(len(picked)) >= minSize {
+			emit(strings.Join(picked, NGramSeparator))
+		}
+		if uint(len(picked)) == maxSize {
+			return
+		}
+		for next := last + 1; next < len(words) && uint(next-last-1) <= skip; next++ {
+			picked = append(picked, words[next])
+			extend(next, skip-uint(next-last-1))
+			picked = picked[:len(picked)-1]
+		}
+	}
+	for first, word := range words {
+		picked = append(picked[:0], word)
+		extend(first, g.Skip)
+	}
+}
+
+// JoinNGram returns the key of the n-gram of the words, to be queried.
+func JoinNGram(words ...string) string {
+	return strings.Join(words, NGramSeparator)
+}
+
+// ngramSize returns the number of words in the n-gram of a key.
+func ngramSize(key string) uint {
+	return uint(strings.Count(key, NGramSeparator)) + 1
+}
+
+// NormalizeNGram splits a phrase into words and normalizes them in the same
+// way as a line, and returns the key of the n-gram of the words. It returns
+// "" and false if all words are dropped. It is useful for normalizing a phrase
+// to be queried, so that query("TCP three-way") finds "tcp three-way" when
+// "FoldCase" is set.
+func (t Tokenizer) NormalizeNGram(phrase string) (string, bool) {
+	var words []string
+	t.Tokenize(phrase, func(token string, offset uint) {
+		words = append(words, token)
+	})
+	if len(words) == 0 {
+		return "", false
+	}
+	return JoinNGram(words...), true
+}
+
+// CountNGrams returns the Mapper used for counting the n-grams of the words
+// split by the Tokenizer. It emits each n-gram with a count of 1. With the
+// zero NGrams, it is the same as CountTokens.
+func CountNGrams(t Tokenizer, g NGrams) Mapper[string, string, uint] {
+	if minSize, maxSize := g.sizes(); minSize == 1 && maxSize == 1 {
+		return CountTokens(t)
+	}
+	return func(lineNo uint, line string, emit func(string, uint)) {
+		var words []string
+		t.Tokenize(line, func(token string, offset uint) {
+			words = append(words, token)
+		})
+		g.each(words, func(key string) {
+			emit(key, 1)
+		})
+	}
+}
+
+// WithNGrams returns an Option which counts the n-grams described by g,
+// instead of the words only. The n-grams go through the same partitioners
+// and reducers as the words, keyed by JoinNGram, so "Query" and the other
+// queries work for them as well. Only networks counting words (NewNetwork
+// and Setup) support this option.
+func WithNGrams(g NGrams) Option {
+	return func(c *config) {
+		c.ngrams = g
+	}
+}
@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+)
+
+///////////
+// Tests //
+///////////
+
+// TestCountNGrams checks the Mapper returned by CountNGrams() with predefined
+// test cases.
+func TestCountNGrams(t *testing.T) {
+	cases := []struct {
+		ngrams   NGrams
+		line     string
+		expected []string
+	}{
+		{NGrams{}, "a b c", []string{"a", "b", "c"}},
+		{NGrams{Min: 2}, "a b c", []string{"a b", "b c"}},
+		{NGrams{Min: 1, Max: 2}, "a b c", []string{"a", "a b", "b", "b c", "c"}},
+		{NGrams{Min: 2, Max: 3}, "a b c d", []string{"a b", "a b c", "b c", "b c d", "c d"}},
+		{NGrams{Min: 3}, "a b", nil},
+		{NGrams{Min: 2, Skip: 1}, "a b c", []string{"a b", "a c", "b c"}},
+		{NGrams{Min: 3, Skip: 1}, "a b c d", []string{"a b c", "a b d", "a c d", "b c d"}},
+		{NGrams{Min: 2, Skip: 2}, "a b c d", []string{"a b", "a c", "a d", "b c", "b d", "c d"}},
+	}
+	for _, c := range cases {
+		var got []string
+		CountNGrams(Tokenizer{}, c.ngrams)(0, c.line, func(key string, count uint) {
+			got = append(got, key)
+		})
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("CountNGrams(%+v) emitted %q for %q, expected %q", c.ngrams, got, c.line, c.expected)
+		}
+	}
+}
+
+// TestNormalizeNGram checks the method Tokenizer.NormalizeNGram() with
+// predefined test cases.
+func TestNormalizeNGram(t *testing.T) {
+	tokenizer := Tokenizer{FoldCase: true, StripPunctuation: true, StopWords: map[string]bool{"the": true}}
+	cases := []struct {
+		phrase   string
+		expected string
+		ok       bool
+	}{
+		{"TCP", "tcp", true},
+		{"TCP  three-way,", "tcp three-way", true},
+		{"the TCP", "tcp", true},
+		{"The", "", false},
+	}
+	for _, c := range cases {
+		if got, ok := tokenizer.NormalizeNGram(c.phrase); got != c.expected || ok != c.ok {
+			t.Errorf("NormalizeNGram(%q) = %q, %v, expected %q, %v", c.phrase, got, ok, c.expected, c.ok)
+		}
+	}
+}
+
+// TestWithNGrams checks that the n-grams counted by a network could be
+// queried like the words.
+func TestWithNGrams(t *testing.T) {
+	network := newTestNetwork(t, 2, 1, 3, WithNGrams(NGrams{Min: 1, Max: 2}))
+	defer network.Close()
+	network.Map(0, "the TCP three-way handshake")
+	network.Map(1, "a TCP three-way handshake")
+	network.Map(2, "TCP")
+
+	if got := network.Query("TCP three-way"); got != 2 {
+		t.Errorf("Query(%q) = %d, expected 2", "TCP three-way", got)
+	}
+	if got := network.Query(JoinNGram("three-way", "handshake")); got != 2 {
+		t.Errorf("Query(%q) = %d, expected 2", "three-way handshake", got)
+	}
+	if got := network.Query("TCP"); got != 3 {
+		t.Errorf("Query(%q) = %d, expected 3", "TCP", got)
+	}
+	expected := []WordCount{{"TCP three-way", 2}, {"three-way handshake", 2}, {"a TCP", 1}}
+	if got := network.TopKNGrams(3, 2); !equalWordCounts(got, expected) {
+		t.Errorf("TopKNGrams(3, 2) = %v, expected %v", got, expected)
+	}
+	if got := network.TopK(1); !equalWordCounts(got, []WordCount{{"TCP", 3}}) {
+		t.Errorf("TopK(1) = %v, expected [{TCP 3}]", got)
+	}
+}
@@ -0,0 +1,140 @@
+package lib
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// The Partitioner interface decides which reducer a key is sent to.
+// Partition returns the index of the reducer, in [0, reducerCount), for the
+// key. It must return the same index for the same key and reducer count, and
+// it is called by the partitioner goroutines concurrently.
+type Partitioner interface {
+	Partition(key string, reducerCount int) int
+}
+
+// The PartitionerFunc type is an adapter to allow the use of ordinary
+// functions as partitioners, like http.HandlerFunc.
+type PartitionerFunc func(key string, reducerCount int) int
+
+// Partition calls f(key, reducerCount).
+func (f PartitionerFunc) Partition(key string, reducerCount int) int {
+	return f(key, reducerCount)
+}
+
+// The FNVPartitioner struct is the default Partitioner. It sends a key to the
+// reducer given by its FNV-1a hash code modulo the reducer count.
+type FNVPartitioner struct{}
+
+// Partition returns the FNV-1a hash code of key modulo reducerCount.
+func (FNVPartitioner) Partition(key string, reducerCount int) int {
+	return int(hashCode(key) % uint32(reducerCount))
+}
+
+// The RangePartitioner struct sends the keys in ranges of lexicographical
+// order to the reducers. It keeps keys with the same prefix together, at the
+// cost of skew if the keys are not spread evenly.
+// "Bounds" are the sorted split points: reducer 0 receives the keys less than
+// Bounds[0], reducer i receives the keys in [Bounds[i-1], Bounds[i]), and the
+// last reducer receives the rest. If there are fewer reducers than ranges,
+// the extra ranges go to the last reducer.
+type RangePartitioner struct {
+	Bounds []string
+}
+
+// Partition returns the index of the range the key falls into.
+func (p RangePartitioner) Partition(key string, reducerCount int) int {
+	i := sort.SearchStrings(p.Bounds, key)
+	if i < len(p.Bounds) && p.Bounds[i] == key {
+		i++
+	}
+	return min(i, reducerCount-1)
+}
+
+// The ConsistentHashPartitioner struct sends keys to the reducers with a
+// consistent hash ring. Each reducer is placed on the ring at "virtualNodes"
+// points, and a key goes to the reducer owning the first point at or after the
+// hash code of the key. When the reducer count changes from n to n + 1, only
+// about 1 / (n + 1) of the keys are moved (all to the new reducer), instead of
+// almost all keys as with FNVPartitioner.
+type ConsistentHashPartitioner struct {
+	virtualNodes int
+	mutex        sync.RWMutex
+	rings        map[int]*hashRing
+}
+
+// The hashRing struct is a consistent hash ring for a reducer count.
+// "points" are the sorted positions of the virtual nodes on the ring, and
+// "owners" are the indexes of the reducers owning them.
+type hashRing struct {
+	points []uint32
+	owners []int
+}
+
+// NewConsistentHashPartitioner returns a ConsistentHashPartitioner placing
+// each reducer at virtualNodes points on the ring. More virtual nodes spread
+// the keys more evenly. If virtualNodes is 0, 100 is used.
+func NewConsistentHashPartitioner(virtualNodes int) *ConsistentHashPartitioner {
+	if virtualNodes <= 0 {
+		virtualNodes = 100
+	}
+	return &ConsistentHashPartitioner{
+		virtualNodes: virtualNodes,
+		rings:        make(map[int]*hashRing),
+	}
+}
+
+// ring returns the hash ring for a reducer count, building it on first use.
+// The points of a reducer do not depend on the reducer count, so the rings for
+// n and n + 1 reducers differ only by the points of the new reducer.
+func (p *ConsistentHashPartitioner) ring(reducerCount int) *hashRing {
+	p.mutex.RLock()
+	r, ok := p.rings[reducerCount]
+	p.mutex.RUnlock()
+	if ok {
+		return r
+	}
+
+	type point struct {
+		position uint32
+		owner    int
+	}
+	points := make([]point, 0, reducerCount*p.virtualNodes)
+	for owner := 0; owner < reducerCount; owner++ {
+		for i := 0; i < p.virtualNodes; i++ {
+			points = append(points, point{hashCode(fmt.Sprintf("reducer-%d#%d", owner, i)), owner})
+		}
+	}
+	slices.SortFunc(points, func(p1, p2 point) int {
+		switch {
+		case p1.position < p2.position:
+			return -1
+		case p1.position > p2.position:
+			return 1
+		}
+		return p1.owner - p2.owner
+	})
+	r = &hashRing{make([]uint32, len(points)), make([]int, len(points))}
+	for i, pt := range points {
+		r.points[i], r.owners[i] = pt.position, pt.owner
+	}
+
+	p.mutex.Lock()
+	p.rings[reducerCount] = r
+	p.mutex.Unlock()
+	return r
+}
+
+// Partition returns the reducer owning the first point on the ring at or
+// after the hash code of the key.
+func (p *ConsistentHashPartitioner) Partition(key string, reducerCount int) int {
+	r := p.ring(reducerCount)
+	hc := hashCode(key)
+	i, _ := slices.BinarySearch(r.points, hc)
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[i]
+}
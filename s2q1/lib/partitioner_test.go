@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"fmt"
+	"testing"
+)
+
+///////////
+// Tests //
+///////////
+
+// TestRangePartitioner checks the method RangePartitioner.Partition() with
+// predefined test cases.
+func TestRangePartitioner(t *testing.T) {
+	p := RangePartitioner{[]string{"h", "p"}}
+	cases := []struct {
+		key          string
+		reducerCount int
+		expected     int
+	}{
+		{"", 3, 0},
+		{"apple", 3, 0},
+		{"h", 3, 1},
+		{"hello", 3, 1},
+		{"p", 3, 2},
+		{"zebra", 3, 2},
+		{"zebra", 2, 1},
+		{"hello", 1, 0},
+	}
+	for _, c := range cases {
+		if got := p.Partition(c.key, c.reducerCount); got != c.expected {
+			t.Errorf("Partition(%q, %d) = %d, expected %d", c.key, c.reducerCount, got, c.expected)
+		}
+	}
+}
+
+// TestConsistentHashPartitioner checks that the keys are spread over all
+// reducers, and that adding a reducer only moves keys to the new reducer.
+func TestConsistentHashPartitioner(t *testing.T) {
+	p := NewConsistentHashPartitioner(0)
+	const keyCount = 10000
+	for reducerCount := 1; reducerCount < 8; reducerCount++ {
+		counts := make([]int, reducerCount)
+		moved := 0
+		for i := 0; i < keyCount; i++ {
+			key := fmt.Sprintf("word%d", i)
+			before := p.Partition(key, reducerCount)
+			after := p.Partition(key, reducerCount+1)
+			counts[before]++
+			if before != after {
+				moved++
+				if after != reducerCount {
+					t.Errorf("%q moved from reducer %d to %d when reducer %d is added", key, before, after, reducerCount)
+				}
+			}
+		}
+		for i, count := range counts {
+			if count < keyCount/reducerCount/2 {
+				t.Errorf("reducer %d of %d has %d keys out of %d", i, reducerCount, count, keyCount)
+			}
+		}
+		if moved > keyCount*2/(reducerCount+1) {
+			t.Errorf("%d keys out of %d moved when reducer %d is added", moved, keyCount, reducerCount)
+		}
+	}
+}
+
+// TestWithPartitioner checks that the counts do not depend on the Partitioner.
+func TestWithPartitioner(t *testing.T) {
+	partitioners := []Partitioner{
+		FNVPartitioner{},
+		NewConsistentHashPartitioner(10),
+		RangePartitioner{[]string{"m"}},
+		PartitionerFunc(func(key string, reducerCount int) int {
+			return len(key) % reducerCount
+		}),
+	}
+	for _, p := range partitioners {
+		mapFunc, query, queryAll, shutdown := Setup(2, 2, 3, WithPartitioner(p))
+		for lineNo := uint(0); lineNo < 50; lineNo++ {
+			mapFunc(lineNo, "a TCP zebra TCP")
+		}
+		if got := query("TCP"); got != 100 {
+			t.Errorf("%T: query(%q) = %d, expected 100", p, "TCP", got)
+		}
+		if got := queryAll(); len(got) != 3 || got["zebra"] != 50 {
+			t.Errorf("%T: queryAll() = %v", p, got)
+		}
+		shutdown()
+	}
+}
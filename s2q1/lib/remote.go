@@ -0,0 +1,298 @@
+package lib
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"net/rpc"
+	"sync"
+)
+
+// remoteBatchSize is the maximum number of counts sent to a worker process in
+// one remote procedure call.
+const remoteBatchSize = 1024
+
+// The ReducerServer struct is the service run by a worker process, which
+// keeps the dictionary of a reducer on behalf of a map-reduce network running
+// in another process. Its methods are called through net/rpc by
+// remoteReducerRoutine, and are not meant to be called directly.
+type ReducerServer struct {
+	mutex      sync.Mutex
+	dictionary map[string]uint
+}
+
+// The ReducerUpdate struct is the argument of ReducerServer.Update.
+// "Deleted" are the words to be removed from the dictionary.
+// "Put" are the words to be set to the counts given.
+type ReducerUpdate struct {
+	Deleted []string
+	Put     []WordCount
+}
+
+// The ReducerDelta struct is the argument of ReducerServer.Add: a signed
+// delta to be added to the count of a word.
+type ReducerDelta struct {
+	Word  string
+	Delta int64
+}
+
+// Reset empties the dictionary. It is called when a network connects to the
+// worker, so that the counts of a previous network are not mixed in, and when
+// the network is reset.
+func (s *ReducerServer) Reset(_ bool, _ *bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.dictionary = make(map[string]uint)
+	return nil
+}
+
+// Reduce adds the counts to the dictionary.
+func (s *ReducerServer) Reduce(wcs []WordCount, _ *bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, wc := range wcs {
+		s.dictionary[wc.Word] += wc.Count
+	}
+	return nil
+}
+
+// Add adds a signed delta to the count of a word, in the same way as
+// reducerRoutine does (see addDelta).
+func (s *ReducerServer) Add(delta ReducerDelta, _ *bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count, zero, err := addDelta(s.dictionary[delta.Word], delta.Delta)
+	if err != nil {
+		return err
+	}
+	if zero {
+		delete(s.dictionary, delta.Word)
+	} else {
+		s.dictionary[delta.Word] = count
+	}
+	return nil
+}
+
+// Query returns the count of a word.
+func (s *ReducerServer) Query(word string, count *uint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	*count = s.dictionary[word]
+	return nil
+}
+
+// Distinct returns the number of words in the dictionary.
+func (s *ReducerServer) Distinct(_ bool, count *uint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	*count = uint(len(s.dictionary))
+	return nil
+}
+
+// Select returns the words selected by the filter from the dictionary.
+func (s *ReducerServer) Select(filter WordFilter, wcs *[]WordCount) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch filter.Kind {
+	case filterAll, filterTopK, filterPrefix, filterCountRange:
+		*wcs = filter.apply(maps.All(s.dictionary))
+		return nil
+	}
+	return fmt.Errorf("Unknown filter: %q", filter.Kind)
+}
+
+// Update removes and sets words in the dictionary.
+func (s *ReducerServer) Update(update ReducerUpdate, _ *bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, word := range update.Deleted {
+		delete(s.dictionary, word)
+	}
+	for _, wc := range update.Put {
+		s.dictionary[wc.Word] = wc.Count
+	}
+	return nil
+}
+
+// ServeReducer runs a worker process's reducer service on the listener, so
+// that a map-reduce network created with WithRemoteReducers could keep its
+// counts in this process. It blocks until the listener is closed.
+func ServeReducer(listener net.Listener) error {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Reducer", &ReducerServer{dictionary: make(map[string]uint)}); err != nil {
+		return err
+	}
+	server.Accept(listener)
+	return nil
+}
+
+// dialReducers connects to the worker processes at the addresses, and resets
+// their dictionaries. If any of them fails, the connections made are closed.
+func dialReducers(addresses []string) ([]*rpc.Client, error) {
+	clients := make([]*rpc.Client, 0, len(addresses))
+	for _, address := range addresses {
+		client, err := rpc.Dial("tcp", address)
+		if err == nil {
+			err = client.Call("Reducer.Reset", true, new(bool))
+			if err != nil {
+				client.Close()
+			}
+		}
+		if err != nil {
+			for _, c := range clients {
+				c.Close()
+			}
+			return nil, fmt.Errorf("Cannot connect to reducer at %s: %v", address, err)
+		}
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
+// remoteReducerRoutine is the function executed instead of reducerRoutine
+// for a reducer whose dictionary is kept by a worker process. It is a proxy:
+// it handles the same types of requests as reducerRoutine, by calling the
+// ReducerServer of the worker through "client":
+// (1) If the "Type" is MAP, the count is appended to a batch, which is sent
+//     when it is full, or before any other type of request is handled. A
+//     BATCH is handled as a MAP for each of its pairs;
+// (2) If the "Type" is QUERY, the count is queried from the worker;
+// (3) If the "Type" is QUERY_ALL, the whole dictionary is fetched from the
+//     worker and sent to "replyChannel" like reducerRoutine does;
+// (4) If the "Type" is VISIT with a WordFilter, only the words selected by the
+//     filter are fetched, and "visit" is called with them. Since "visit" only
+//     reads the words selected by the filter, the result is the same as if
+//     it is called with the whole dictionary. A keyed VISIT is handled in the
+//     same way, with the count of "key" queried from the worker. A VISIT
+//     without "visit" is only replied;
+// (5) If the "Type" is VISIT without a filter, the whole dictionary is fetched
+//     and "visit" is called with it. The changes made by "visit" (when the
+//     reducers are scaled) are then sent back to the worker;
+// (6) If the "Type" is DISTINCT, the number of words is queried from the
+//     worker;
+// (7) If the "Type" is ADD, DELETE or RESET, the dictionary of the worker is
+//     changed by calling Add, Update or Reset, and a result with "done" set
+//     to true is sent to "replyChannel".
+// A failed remote procedure call is passed to "report" as a StageError. The
+// counts in a failed batch are lost, a failed QUERY is replied with 0, and a
+// failed VISIT is made with an empty dictionary.
+// The connection is closed when reducerChannel is closed.
+func remoteReducerRoutine(
+	client *rpc.Client,
+	reducerChannel <-chan message[string, uint, uint],
+	syncChannel chan<- bool,
+	report func(error)) {
+
+	call := func(method string, args any, reply any) bool {
+		if err := client.Call("Reducer."+method, args, reply); err != nil {
+			report(&StageError{Stage: "reducer", Input: "a call to " + method, Value: err})
+			return false
+		}
+		return true
+	}
+	selectWords := func(filter WordFilter) map[string]uint {
+		var wcs []WordCount
+		if !call("Select", filter, &wcs) {
+			return make(map[string]uint)
+		}
+		dictionary := make(map[string]uint, len(wcs))
+		for _, wc := range wcs {
+			dictionary[wc.Word] = wc.Count
+		}
+		return dictionary
+	}
+
+	var batch []WordCount
+	sendBatch := func() {
+		if len(batch) > 0 {
+			call("Reduce", batch, new(bool))
+			batch = batch[:0]
+		}
+	}
+
+	for msg := range reducerChannel {
+		if msg.Type != MAP && msg.Type != BATCH {
+			sendBatch()
+		}
+		switch msg.Type {
+		case MAP, BATCH:
+			msg.each(func(word string, count uint) {
+				batch = append(batch, WordCount{word, count})
+				if len(batch) >= remoteBatchSize {
+					sendBatch()
+				}
+			})
+		case QUERY:
+			var count uint
+			call("Query", msg.key, &count)
+			msg.reply(result[string, uint]{key: msg.key, value: count})
+		case QUERY_ALL:
+			for word, count := range selectWords(WordFilter{}) {
+				if !msg.reply(result[string, uint]{key: word, value: count}) {
+					break
+				}
+			}
+			msg.reply(result[string, uint]{done: true})
+		case VISIT:
+			if msg.visit == nil {
+				// A barrier is only replied (see barrier).
+			} else if msg.keyed {
+				var count uint
+				dictionary := make(map[string]uint)
+				if call("Query", msg.key, &count) && count > 0 {
+					dictionary[msg.key] = count
+				}
+				protect("reducer", visitInput, report, func() {
+					msg.visit(dictionary)
+				})
+			} else if filter, ok := msg.filter.(WordFilter); ok {
+				dictionary := selectWords(filter)
+				protect("reducer", visitInput, report, func() {
+					msg.visit(dictionary)
+				})
+			} else {
+				dictionary := selectWords(WordFilter{})
+				before := maps.Clone(dictionary)
+				protect("reducer", visitInput, report, func() {
+					msg.visit(dictionary)
+				})
+				var update ReducerUpdate
+				for word, count := range before {
+					if _, ok := dictionary[word]; !ok {
+						update.Deleted = append(update.Deleted, word)
+					} else if dictionary[word] != count {
+						update.Put = append(update.Put, WordCount{word, dictionary[word]})
+					}
+				}
+				for word, count := range dictionary {
+					if _, ok := before[word]; !ok {
+						update.Put = append(update.Put, WordCount{word, count})
+					}
+				}
+				if len(update.Deleted) > 0 || len(update.Put) > 0 {
+					call("Update", update, new(bool))
+				}
+			}
+			msg.reply(result[string, uint]{done: true})
+		case DISTINCT:
+			var count uint
+			call("Distinct", true, &count)
+			msg.reply(result[string, uint]{distinct: count})
+			msg.reply(result[string, uint]{done: true})
+		case ADD:
+			call("Add", ReducerDelta{msg.key, msg.delta}, new(bool))
+			msg.reply(result[string, uint]{done: true})
+		case DELETE:
+			call("Update", ReducerUpdate{Deleted: []string{msg.key}}, new(bool))
+			msg.reply(result[string, uint]{done: true})
+		case RESET:
+			call("Reset", true, new(bool))
+			msg.reply(result[string, uint]{done: true})
+		default:
+			panic(fmt.Sprintf("Unknown case: %d", msg.Type))
+		}
+	}
+	sendBatch()
+	client.Close()
+	syncChannel <- true
+}
@@ -0,0 +1,72 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+)
+
+///////////
+// Tests //
+///////////
+
+// TestWithRemoteReducers checks that a network with reducers in worker
+// "processes" (goroutines serving on local TCP ports) gives the same answers
+// as a network with local reducers.
+func TestWithRemoteReducers(t *testing.T) {
+	var addresses []string
+	for i := 0; i < 3; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("net.Listen() = %v", err)
+		}
+		defer listener.Close()
+		go ServeReducer(listener)
+		addresses = append(addresses, listener.Addr().String())
+	}
+
+	local := newTestNetwork(t, 2, 2, 2)
+	defer local.Close()
+	for round := 0; round < 2; round++ {
+		// The second round checks that the workers are reset.
+		remote := newTestNetwork(t, 2, 2, 0, WithRemoteReducers(addresses...))
+		for lineNo := uint(0); lineNo < 3000; lineNo++ {
+			line := fmt.Sprintf("TCP w%d w%d", lineNo%7, lineNo%1500)
+			remote.Map(lineNo, line)
+			if round == 0 {
+				local.Map(lineNo, line)
+			}
+		}
+		if got := remote.Stats().Reducers; got != 3 {
+			t.Errorf("Stats().Reducers = %d, expected 3", got)
+		}
+		if got := remote.Query("TCP"); got != 3000 {
+			t.Errorf("Query(%q) = %d, expected 3000", "TCP", got)
+		}
+		if got, expected := remote.DistinctCount(), local.DistinctCount(); got != expected {
+			t.Errorf("DistinctCount() = %d, expected %d", got, expected)
+		}
+		if got, expected := remote.QueryAll(), local.QueryAll(); !reflect.DeepEqual(got, expected) {
+			t.Errorf("QueryAll() has %d words, expected %d", len(got), len(expected))
+		}
+		if got, expected := remote.TopK(5), local.TopK(5); !reflect.DeepEqual(got, expected) {
+			t.Errorf("TopK(5) = %v, expected %v", got, expected)
+		}
+		if got, expected := remote.Prefix("w14"), local.Prefix("w14"); !reflect.DeepEqual(got, expected) {
+			t.Errorf("Prefix(%q) has %d words, expected %d", "w14", len(got), len(expected))
+		}
+		if got, expected := remote.CountRange(2, 2), local.CountRange(2, 2); !reflect.DeepEqual(got, expected) {
+			t.Errorf("CountRange(2, 2) has %d words, expected %d", len(got), len(expected))
+		}
+		if err := remote.ScaleReducers(4); err == nil {
+			t.Errorf("ScaleReducers(4) returns a nil error")
+		}
+		var buffer bytes.Buffer
+		if err := remote.Snapshot(&buffer); err != nil {
+			t.Errorf("Snapshot() = %v", err)
+		}
+		remote.Close()
+	}
+}
@@ -0,0 +1,177 @@
+package lib
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// scaleReducers changes the number of reducers of a running network to
+// reducerCount, and migrates the keys whose reducer is changed.
+//
+// It works as follows:
+// (1) The routing table is write-locked. Since a partitioner read-locks it
+//     while forwarding a message, no message is being forwarded after this,
+//     and the partitioners (and hence the mappers) wait until (5). Queries
+//     are not lost either: they wait in the partitioners too;
+// (2) If reducers are added, their goroutines are started;
+// (3) A VISIT is sent to each existing reducer, which removes the keys
+//     belonging to another reducer under the new reducer count from its
+//     dictionary. Since a reducer handles messages in order, all the messages
+//     forwarded to it before (1) are reduced before the keys are removed;
+// (4) A VISIT is sent to each reducer receiving keys, which puts the keys
+//     into its dictionary. A key belongs to exactly one reducer at any time,
+//     so the reducer receiving the key does not have it yet;
+// (5) If reducers are removed, their channels (which have no keys left) are
+//     closed. The routing table is updated and unlocked.
+//
+// If the Partitioner panics or returns an index out of range for a key, a
+// StageError is reported, and the key is left where it is. Since the key
+// could not be kept by a removed reducer, the scaling is then aborted after
+// (3): the removed keys are put back to their reducers, the added reducers
+// are terminated, and the routing table is left unchanged.
+//
+// It returns a non-nil error if reducerCount is 0, if the reducers are remote
+// or approximate, or if the scaling is aborted.
+func (n *network[R, K, V, A]) scaleReducers(reducerCount uint) error {
+	if reducerCount == 0 {
+		return fmt.Errorf("The reducer count must be positive")
+	}
+	if n.remote {
+		return fmt.Errorf("Remote reducers could not be scaled")
+	}
+	if n.approximate {
+		return fmt.Errorf("Approximate reducers could not be scaled")
+	}
+
+	n.routing.mutex.Lock()
+	defer n.routing.mutex.Unlock()
+
+	oldChannels := n.routing.reducerChannels
+	newCount := int(reducerCount)
+	channels := oldChannels
+	routed := n.routing.routed
+	for len(channels) < newCount {
+		rc := make(chan message[K, V, A], n.bufferSize)
+		channels = append(channels, rc)
+		routed = append(routed, new(atomic.Uint64))
+		n.startReducer(rc)
+	}
+
+	// visit sends a VISIT to the reducers, each with its own visit function,
+	// and waits until all of them are done.
+	visit := func(visits map[int]func(map[K]A)) {
+		replyChannel := make(chan result[K, A], len(visits))
+		for i, v := range visits {
+			channels[i] <- message[K, V, A]{Type: VISIT, replyChannel: replyChannel, visit: v}
+		}
+		for range visits {
+			<-replyChannel
+		}
+	}
+
+	// Remove the keys to be moved. moved[i][j] holds the keys moved from
+	// reducer i to reducer j. Each reducer writes to its own moved[i].
+	moved := make([]map[int]map[K]A, len(oldChannels))
+	for i := range moved {
+		moved[i] = make(map[int]map[K]A)
+	}
+	// failed[i] counts the keys of reducer i which the Partitioner fails on.
+	failed := make([]int, len(oldChannels))
+	removals := make(map[int]func(map[K]A))
+	for i := range oldChannels {
+		removals[i] = func(dictionary map[K]A) {
+			for key, value := range dictionary {
+				j := -1
+				ok := protect("partitioner", keyInput(key), n.errors.report, func() {
+					j = n.partitioner.Partition(keyString(key), newCount)
+				})
+				if ok && (j < 0 || j >= newCount) {
+					n.errors.report(&StageError{
+						Stage: "partitioner",
+						Input: keyInput(key)(),
+						Value: fmt.Sprintf("%T returned %d, not in [0, %d)", n.partitioner, j, newCount),
+					})
+					ok = false
+				}
+				if !ok {
+					failed[i]++
+					continue
+				}
+				if j == i {
+					continue
+				}
+				if moved[i][j] == nil {
+					moved[i][j] = make(map[K]A)
+				}
+				moved[i][j][key] = value
+				delete(dictionary, key)
+			}
+		}
+	}
+	visit(removals)
+
+	failures := 0
+	for _, count := range failed {
+		failures += count
+	}
+	if failures > 0 {
+		// Put the removed keys back, and terminate the added reducers.
+		restores := make(map[int]func(map[K]A))
+		for i := range moved {
+			entriesByReducer := moved[i]
+			restores[i] = func(dictionary map[K]A) {
+				for _, entries := range entriesByReducer {
+					for key, value := range entries {
+						dictionary[key] = value
+					}
+				}
+				// The keys are put by the first call only (see puts).
+				entriesByReducer = nil
+			}
+		}
+		visit(restores)
+		for _, rc := range channels[len(oldChannels):] {
+			close(rc)
+			<-n.syncChannel
+		}
+		return fmt.Errorf("The reducers are not scaled, since the partitioner failed on %d keys", failures)
+	}
+
+	// Put the keys to their new reducers.
+	incoming := make(map[int][]map[K]A)
+	for i := range moved {
+		for j, entries := range moved[i] {
+			incoming[j] = append(incoming[j], entries)
+		}
+	}
+	puts := make(map[int]func(map[K]A))
+	for j, entriesList := range incoming {
+		puts[j] = func(dictionary map[K]A) {
+			for _, entries := range entriesList {
+				for key, value := range entries {
+					dictionary[key] = value
+				}
+			}
+			// A reducer spilling to disk calls visit with each part of its
+			// dictionary, so the keys are put by the first call only.
+			entriesList = nil
+		}
+	}
+	visit(puts)
+
+	// Terminate the removed reducerRoutines gracefully
+	for _, rc := range channels[newCount:] {
+		close(rc)
+		<-n.syncChannel
+	}
+	n.routing.reducerChannels = channels[:newCount:newCount]
+	n.routing.routed = routed[:newCount:newCount]
+	return nil
+}
+
+// reducerCount returns the current number of reducers.
+func (n *network[R, K, V, A]) reducerCount() uint {
+	n.routing.mutex.RLock()
+	defer n.routing.mutex.RUnlock()
+	return uint(len(n.routing.reducerChannels))
+}
@@ -0,0 +1,130 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"sync"
+	"testing"
+)
+
+///////////
+// Tests //
+///////////
+
+// TestScaleReducers checks that the counts are not affected when reducers are
+// added and removed, while lines are being mapped and queries are being made.
+func TestScaleReducers(t *testing.T) {
+	partitioners := []Partitioner{
+		FNVPartitioner{},
+		NewConsistentHashPartitioner(0),
+	}
+	for _, p := range partitioners {
+		network := newTestNetwork(t, 3, 2, 2, WithPartitioner(p))
+		if err := network.ScaleReducers(0); err == nil {
+			t.Errorf("%T: ScaleReducers(0) returns a nil error", p)
+		}
+
+		// Map lines while the reducers are scaled.
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for lineNo := uint(0); lineNo < 1000; lineNo++ {
+				network.Map(lineNo, fmt.Sprintf("TCP w%d", lineNo%100))
+			}
+		}()
+		for _, reducerCount := range []uint{5, 1, 8, 3} {
+			if err := network.ScaleReducers(reducerCount); err != nil {
+				t.Errorf("%T: ScaleReducers(%d) = %v", p, reducerCount, err)
+			}
+			if got := network.Stats().Reducers; got != reducerCount {
+				t.Errorf("%T: Stats().Reducers = %d, expected %d", p, got, reducerCount)
+			}
+			if got := network.Query("TCP"); got > 1000 {
+				t.Errorf("%T: Query(%q) = %d, expected at most 1000", p, "TCP", got)
+			}
+		}
+		wg.Wait()
+
+		if got := network.Query("TCP"); got != 1000 {
+			t.Errorf("%T: Query(%q) = %d, expected 1000", p, "TCP", got)
+		}
+		dictionary := network.QueryAll()
+		if len(dictionary) != 101 {
+			t.Errorf("%T: QueryAll() has %d words, expected 101", p, len(dictionary))
+		}
+		for i := 0; i < 100; i++ {
+			if got := dictionary[fmt.Sprintf("w%d", i)]; got != 10 {
+				t.Errorf("%T: QueryAll()[%q] = %d, expected 10", p, fmt.Sprintf("w%d", i), got)
+			}
+		}
+		if got := network.TopK(1); len(got) != 1 || got[0] != (WordCount{"TCP", 1000}) {
+			t.Errorf("%T: TopK(1) = %v", p, got)
+		}
+		network.Close()
+	}
+}
+
+// TestScaleReducersPartitionerFailure checks that the scaling is aborted,
+// without losing any key, if the Partitioner panics or returns an index out
+// of range under the new reducer count.
+func TestScaleReducersPartitionerFailure(t *testing.T) {
+	cases := []struct {
+		key          string
+		reducerCount uint
+	}{
+		{"far", 4},
+		{"far", 1},
+		{"boom", 3},
+		{"boom", 1},
+	}
+	for _, c := range cases {
+		var mutex sync.Mutex
+		var stageErrors []*StageError
+		handler := func(err error) {
+			var stageError *StageError
+			if errors.As(err, &stageError) {
+				mutex.Lock()
+				stageErrors = append(stageErrors, stageError)
+				mutex.Unlock()
+			}
+		}
+		// The Partitioner fails on "far" and "boom" only after the scaling.
+		partitioner := PartitionerFunc(func(key string, reducerCount int) int {
+			if reducerCount != 2 {
+				switch key {
+				case "boom":
+					panic("bad key")
+				case "far":
+					return reducerCount
+				}
+			}
+			return FNVPartitioner{}.Partition(key, reducerCount)
+		})
+		network := newTestNetwork(t, 2, 2, 2, WithPartitioner(partitioner), WithErrorHandler(handler))
+		for lineNo := uint(0); lineNo < 10; lineNo++ {
+			network.Map(lineNo, fmt.Sprintf("%s w%d TCP", c.key, lineNo))
+		}
+		before := network.QueryAll()
+
+		if err := network.ScaleReducers(c.reducerCount); err == nil {
+			t.Errorf("%q: ScaleReducers(%d) returns a nil error", c.key, c.reducerCount)
+		}
+		if got := network.Stats().Reducers; got != 2 {
+			t.Errorf("%q: Stats().Reducers = %d after ScaleReducers(%d), expected 2", c.key, got, c.reducerCount)
+		}
+		if got := network.QueryAll(); !maps.Equal(got, before) {
+			t.Errorf("%q: QueryAll() = %v after ScaleReducers(%d), expected %v", c.key, got, c.reducerCount, before)
+		}
+		if got := network.Query(c.key); got != 10 {
+			t.Errorf("%q: Query(%q) = %d, expected 10", c.key, c.key, got)
+		}
+		mutex.Lock()
+		if len(stageErrors) != 1 || stageErrors[0].Stage != "partitioner" {
+			t.Errorf("%q: reported %v, expected one error of the partitioner", c.key, stageErrors)
+		}
+		mutex.Unlock()
+		network.Close()
+	}
+}
@@ -0,0 +1,153 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// QueryHandler returns an http.Handler which answers the queries of the
+// network, and accepts new lines to be counted, in JSON:
+// (1) "GET /count?word=W" replies the count of W as a WordCount;
+// (2) "GET /top?k=N" replies the N (10 if not given) words with the largest
+//     counts, as TopK does. With "size=S", only the n-grams of S words are
+//     considered, as TopKNGrams does;
+// (3) "GET /prefix?prefix=P" replies the words starting with P, as Prefix
+//     does;
+// (4) "POST /lines" maps each line of the request body, and replies the
+//     number of lines mapped as {"lines": N}. The lines are numbered after the
+//     lines passed to Map before the handler is created.
+// The word (or the phrase, when n-grams are counted) and the prefix given are
+// normalized by the Tokenizer set by WithTokenizer before they are queried,
+// so that "TCP" finds "tcp" when "FoldCase" is set. The stop words are not
+// dropped from a prefix, since a word starting with one may be counted. The
+// words replied are as they are counted. A bad parameter is replied with 400
+// Bad Request, a request with another method with 405 Method Not Allowed, and
+// an error is replied as {"error": "..."}.
+func (nw *Network) QueryHandler() http.Handler {
+	var lineNo atomic.Uint64
+	lineNo.Store(nw.Stats().Lines)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/count", allow("GET", func(w http.ResponseWriter, r *http.Request) {
+		word := r.URL.Query().Get("word")
+		if word == "" {
+			writeError(w, http.StatusBadRequest, "The word is not given")
+			return
+		}
+		normalized, ok := nw.tokenizer.NormalizeNGram(word)
+		if !ok {
+			// The word is dropped by the Tokenizer, so it is never counted.
+			writeJSON(w, WordCount{word, 0})
+			return
+		}
+		count, err := nw.QueryContext(r.Context(), normalized)
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		writeJSON(w, WordCount{normalized, count})
+	}))
+	mux.HandleFunc("/top", allow("GET", func(w http.ResponseWriter, r *http.Request) {
+		k, err := uintParameter(r, "k", 10)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		size, err := uintParameter(r, "size", 0)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if size == 0 {
+			writeJSON(w, nonNil(nw.TopK(k)))
+		} else {
+			writeJSON(w, nonNil(nw.TopKNGrams(k, size)))
+		}
+	}))
+	mux.HandleFunc("/prefix", allow("GET", func(w http.ResponseWriter, r *http.Request) {
+		prefix := r.URL.Query().Get("prefix")
+		if prefix == "" {
+			writeError(w, http.StatusBadRequest, "The prefix is not given")
+			return
+		}
+		tokenizer := nw.tokenizer
+		tokenizer.StopWords = nil
+		prefix, ok := tokenizer.Normalize(prefix)
+		if !ok {
+			writeJSON(w, []WordCount{})
+			return
+		}
+		writeJSON(w, nonNil(nw.Prefix(prefix)))
+	}))
+	mux.HandleFunc("/lines", allow("POST", func(w http.ResponseWriter, r *http.Request) {
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(nil, 1024*1024)
+		lines := 0
+		for scanner.Scan() {
+			if err := nw.MapContext(r.Context(), uint(lineNo.Add(1)-1), scanner.Text()); err != nil {
+				writeError(w, http.StatusServiceUnavailable, err.Error())
+				return
+			}
+			lines++
+		}
+		if err := scanner.Err(); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, map[string]int{"lines": lines})
+	}))
+	return mux
+}
+
+// allow returns a handler which calls handler only for the requests with the
+// method, and replies the others with 405 Method Not Allowed.
+func allow(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, "The method must be "+method)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// uintParameter returns the query parameter "name" of the request as a uint,
+// or defaultValue if it is not given.
+func uintParameter(r *http.Request, name string, defaultValue uint) (uint, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return defaultValue, nil
+	}
+	value, err := strconv.ParseUint(s, 10, 0)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid value of %q: %q", name, s)
+	}
+	return uint(value), nil
+}
+
+// nonNil returns wcs, or an empty slice if it is nil, so that it is written
+// as [] instead of null.
+func nonNil(wcs []WordCount) []WordCount {
+	if wcs == nil {
+		return []WordCount{}
+	}
+	return wcs
+}
+
+// writeJSON writes v to w as JSON.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error to w as JSON, with the status code.
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,89 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+///////////
+// Tests //
+///////////
+
+// TestQueryHandler checks the responses of QueryHandler() to the queries and
+// the lines posted, with predefined test cases.
+func TestQueryHandler(t *testing.T) {
+	network := newTestNetwork(t, 2, 2, 3)
+	defer network.Close()
+	network.Map(0, "TCP UDP TCP")
+	handler := network.QueryHandler()
+
+	// serve returns the status and the body of the response to a request.
+	serve := func(method, target, body string) (int, string) {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return recorder.Code, recorder.Body.String()
+	}
+
+	if status, body := serve("POST", "/lines", "TCP IP\nTCP\n\nHTTP"); status != http.StatusOK || body != `{"lines":4}`+"\n" {
+		t.Errorf("POST /lines = %d %s, expected 200 {\"lines\":4}", status, body)
+	}
+	if got := network.Stats().Lines; got != 5 {
+		t.Errorf("Stats().Lines = %d after POST /lines, expected 5", got)
+	}
+
+	cases := []struct {
+		method, target string
+		status         int
+		body           string
+	}{
+		{"GET", "/count?word=TCP", http.StatusOK, `{"word":"TCP","count":4}`},
+		{"GET", "/count?word=DNS", http.StatusOK, `{"word":"DNS","count":0}`},
+		{"GET", "/count", http.StatusBadRequest, `{"error":"The word is not given"}`},
+		{"GET", "/top?k=2", http.StatusOK, `[{"word":"TCP","count":4},{"word":"HTTP","count":1}]`},
+		{"GET", "/top", http.StatusOK, `[{"word":"TCP","count":4},{"word":"HTTP","count":1},{"word":"IP","count":1},{"word":"UDP","count":1}]`},
+		{"GET", "/top?k=2&size=2", http.StatusOK, `[]`},
+		{"GET", "/top?k=two", http.StatusBadRequest, `{"error":"Invalid value of \"k\": \"two\""}`},
+		{"GET", "/prefix?prefix=T", http.StatusOK, `[{"word":"TCP","count":4}]`},
+		{"GET", "/prefix?prefix=X", http.StatusOK, `[]`},
+		{"GET", "/prefix", http.StatusBadRequest, `{"error":"The prefix is not given"}`},
+	}
+	for _, c := range cases {
+		status, body := serve(c.method, c.target, "")
+		if status != c.status || body != c.body+"\n" {
+			t.Errorf("%s %s = %d %s, expected %d %s", c.method, c.target, status, body, c.status, c.body)
+		}
+	}
+	if status, _ := serve("POST", "/count?word=TCP", ""); status != http.StatusMethodNotAllowed {
+		t.Errorf("POST /count = %d, expected %d", status, http.StatusMethodNotAllowed)
+	}
+}
+
+// TestQueryHandlerTokenizer checks that the words and the prefixes queried by
+// QueryHandler() are normalized by the Tokenizer of the network.
+func TestQueryHandlerTokenizer(t *testing.T) {
+	tokenizer := Tokenizer{FoldCase: true, StripPunctuation: true, StopWords: map[string]bool{"the": true}}
+	network := newTestNetwork(t, 2, 2, 3, WithTokenizer(tokenizer))
+	defer network.Close()
+	network.Map(0, "TCP tcp, The theory")
+	handler := network.QueryHandler()
+
+	cases := []struct {
+		target string
+		body   string
+	}{
+		{"/count?word=TCP", `{"word":"tcp","count":2}`},
+		{"/count?word=Tcp!", `{"word":"tcp","count":2}`},
+		{"/count?word=The", `{"word":"The","count":0}`},
+		{"/prefix?prefix=THE", `[{"word":"theory","count":1}]`},
+		{"/prefix?prefix=TC", `[{"word":"tcp","count":2}]`},
+	}
+	for _, c := range cases {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", c.target, nil))
+		if recorder.Code != http.StatusOK || recorder.Body.String() != c.body+"\n" {
+			t.Errorf("GET %s = %d %s, expected 200 %s", c.target, recorder.Code, recorder.Body.String(), c.body)
+		}
+	}
+}
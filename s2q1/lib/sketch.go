@@ -0,0 +1,231 @@
+package lib
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// hashCode64 returns the FNV-1a hash of a string as an unsigned 64-bit
+// integer, mixed by the finalizer of SplitMix64, so that every bit of the
+// result depends on every bit of the input. The sketches need this, since they
+// use the high bits of the hash code as well as the low bits.
+func hashCode64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// The CountMinSketch struct estimates the counts of words in a fixed amount
+// of memory, however many words there are. An estimate is never less than the
+// true count, and with probability at least 1 - delta, it exceeds the true
+// count by at most epsilon * N, where N is the total of all counts added.
+// It keeps "depth" rows of "width" counters. A word is added to one counter
+// in each row, and its estimate is the minimum of these counters.
+type CountMinSketch struct {
+	width  uint64
+	counts [][]uint
+}
+
+// NewCountMinSketch returns an empty CountMinSketch with the error bounds
+// epsilon and delta, both in (0, 1). It takes ceil(e / epsilon) *
+// ceil(ln(1 / delta)) counters.
+func NewCountMinSketch(epsilon, delta float64) *CountMinSketch {
+	width := uint64(math.Ceil(math.E / epsilon))
+	depth := max(int(math.Ceil(math.Log(1/delta))), 1)
+	s := &CountMinSketch{width: width, counts: make([][]uint, depth)}
+	for i := range s.counts {
+		s.counts[i] = make([]uint, width)
+	}
+	return s
+}
+
+// index returns the index of the counter of a word in row i. The indexes of
+// all rows are derived from one hash code by double hashing.
+func (s *CountMinSketch) index(hc uint64, i int) uint64 {
+	h1, h2 := hc&0xffffffff, hc>>32
+	return (h1 + uint64(i)*h2) % s.width
+}
+
+// Add adds count to the count of a word.
+func (s *CountMinSketch) Add(word string, count uint) {
+	hc := hashCode64(word)
+	for i, row := range s.counts {
+		row[s.index(hc, i)] += count
+	}
+}
+
+// Estimate returns the estimated count of a word.
+func (s *CountMinSketch) Estimate(word string) uint {
+	hc := hashCode64(word)
+	estimate := uint(math.MaxUint)
+	for i, row := range s.counts {
+		estimate = min(estimate, row[s.index(hc, i)])
+	}
+	return estimate
+}
+
+// The HyperLogLog struct estimates the number of distinct words in a fixed
+// amount of memory, however many words there are. It keeps 2^precision
+// registers, and the relative standard error of an estimate is about
+// 1.04 / sqrt(2^precision).
+// A word goes to the register given by the high "precision" bits of its hash
+// code, which keeps the maximum position of the first 1 bit in the other bits.
+type HyperLogLog struct {
+	precision uint8
+	registers []uint8
+}
+
+// NewHyperLogLog returns an empty HyperLogLog whose relative standard error is
+// at most stdError, in (0, 1). The precision is between 4 and 18, so the
+// error could not be less than about 0.2%.
+func NewHyperLogLog(stdError float64) *HyperLogLog {
+	registers := math.Pow(1.04/stdError, 2)
+	precision := uint8(min(max(math.Ceil(math.Log2(registers)), 4), 18))
+	return &HyperLogLog{precision: precision, registers: make([]uint8, 1<<precision)}
+}
+
+// Add adds a word. Adding the same word again has no effect.
+func (h *HyperLogLog) Add(word string) {
+	hc := hashCode64(word)
+	i := hc >> (64 - h.precision)
+	// The 1 bit appended makes the rank at most 64 - precision + 1.
+	w := hc<<h.precision | 1<<(h.precision-1)
+	rank := uint8(bits.LeadingZeros64(w) + 1)
+	if rank > h.registers[i] {
+		h.registers[i] = rank
+	}
+}
+
+// Count returns the estimated number of distinct words added.
+// Small numbers are estimated by linear counting of the empty registers,
+// which is more accurate for them.
+func (h *HyperLogLog) Count() uint {
+	m := float64(len(h.registers))
+	sum, zeros := 0.0, 0
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	var alpha float64
+	switch len(h.registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint(math.Round(estimate))
+}
+
+// The approximation struct holds the error bounds of the approximate counting
+// mode set by WithApproximation.
+// "epsilon" and "delta" are the error bounds of the CountMinSketch.
+// "distinctError" is the relative standard error of the HyperLogLog.
+type approximation struct {
+	epsilon       float64
+	delta         float64
+	distinctError float64
+}
+
+// validate checks that the error bounds are all in (0, 1).
+func (a approximation) validate() error {
+	for _, bound := range []float64{a.epsilon, a.delta, a.distinctError} {
+		if !(bound > 0 && bound < 1) {
+			return fmt.Errorf("The error bounds of the approximation must be in (0, 1): %v", bound)
+		}
+	}
+	return nil
+}
+
+// WithApproximation returns an Option which makes the reducers count words
+// approximately, in a fixed amount of memory however many words there are.
+// Instead of a dictionary, each reducer keeps a CountMinSketch with the error
+// bounds epsilon and delta, to estimate the count of a word, and a
+// HyperLogLog with the relative standard error distinctError, to estimate the
+// number of distinct words. All bounds must be in (0, 1).
+//
+// Since the words themselves are not kept, the queries returning words (such
+// as "QueryAll" and "TopK") return no words, and the network could not be
+// snapshotted, or have its reducers scaled. Only networks counting words
+// (NewNetwork and Setup) support this option, and not together with
+// WithRemoteReducers.
+func WithApproximation(epsilon, delta, distinctError float64) Option {
+	return func(c *config) {
+		c.approximation = &approximation{epsilon, delta, distinctError}
+	}
+}
+
+// sketchReducerRoutine is the function executed instead of reducerRoutine in
+// the approximate counting mode. It handles the same types of requests as
+// reducerRoutine, with a CountMinSketch and a HyperLogLog instead of a
+// dictionary:
+// (1) If the "Type" is MAP, the count is added to both sketches. A BATCH is
+//     handled as a MAP for each of its pairs;
+// (2) If the "Type" is QUERY, the estimated count of "key" is sent to
+//     "replyChannel";
+// (3) If the "Type" is QUERY_ALL, only a result with "done" set to true is
+//     sent, since the words are not kept;
+// (4) If the "Type" is VISIT, "visit" is called with an empty dictionary, if
+//     it is not nil;
+// (5) If the "Type" is DISTINCT, the estimated number of distinct words is
+//     sent to "replyChannel" as "distinct";
+// (6) If the "Type" is RESET, both sketches are replaced by empty ones, and a
+//     result with "done" set to true is sent to "replyChannel".
+// ADD and DELETE are not supported, since the counts could not be changed
+// in the sketches (see Network.Add).
+func sketchReducerRoutine(
+	a approximation,
+	reducerChannel <-chan message[string, uint, uint],
+	syncChannel chan<- bool,
+	report func(error)) {
+
+	counts := NewCountMinSketch(a.epsilon, a.delta)
+	distinct := NewHyperLogLog(a.distinctError)
+	for msg := range reducerChannel {
+		switch msg.Type {
+		case MAP, BATCH:
+			msg.each(func(word string, count uint) {
+				counts.Add(word, count)
+				distinct.Add(word)
+			})
+		case QUERY:
+			msg.reply(result[string, uint]{key: msg.key, value: counts.Estimate(msg.key)})
+		case QUERY_ALL:
+			msg.reply(result[string, uint]{done: true})
+		case VISIT:
+			if msg.visit != nil {
+				protect("reducer", visitInput, report, func() {
+					msg.visit(map[string]uint{})
+				})
+			}
+			msg.reply(result[string, uint]{done: true})
+		case RESET:
+			counts = NewCountMinSketch(a.epsilon, a.delta)
+			distinct = NewHyperLogLog(a.distinctError)
+			msg.reply(result[string, uint]{done: true})
+		case DISTINCT:
+			msg.reply(result[string, uint]{distinct: distinct.Count()})
+			msg.reply(result[string, uint]{done: true})
+		default:
+			panic(fmt.Sprintf("Unknown case: %d", msg.Type))
+		}
+	}
+	syncChannel <- true
+}
@@ -0,0 +1,108 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"testing"
+)
+
+///////////
+// Tests //
+///////////
+
+// TestCountMinSketch checks that the estimates of a CountMinSketch are never
+// less than the true counts, and are within the error bound for almost all
+// words.
+func TestCountMinSketch(t *testing.T) {
+	epsilon, delta := 0.001, 0.01
+	s := NewCountMinSketch(epsilon, delta)
+	counts := make(map[string]uint)
+	total := uint(0)
+	for i := 0; i < 20000; i++ {
+		word := fmt.Sprintf("w%d", i%5000)
+		count := uint(i%7 + 1)
+		s.Add(word, count)
+		counts[word] += count
+		total += count
+	}
+	bound := uint(math.Ceil(epsilon * float64(total)))
+	exceeded := 0
+	for word, count := range counts {
+		estimate := s.Estimate(word)
+		if estimate < count {
+			t.Errorf("Estimate(%q) = %d, less than %d", word, estimate, count)
+		}
+		if estimate > count+bound {
+			exceeded++
+		}
+	}
+	if limit := int(delta * float64(len(counts)) * 2); exceeded > limit {
+		t.Errorf("%d of %d estimates exceed the bound %d, expected at most %d", exceeded, len(counts), bound, limit)
+	}
+	if got := s.Estimate("missing"); got > bound {
+		t.Errorf("Estimate(%q) = %d, expected at most %d", "missing", got, bound)
+	}
+}
+
+// TestHyperLogLog checks that the estimates of a HyperLogLog are within 4
+// standard errors of the true numbers of distinct words.
+func TestHyperLogLog(t *testing.T) {
+	stdError := 0.02
+	for _, n := range []int{0, 1, 10, 1000, 20000, 200000} {
+		h := NewHyperLogLog(stdError)
+		for repeat := 0; repeat < 2; repeat++ {
+			for i := 0; i < n; i++ {
+				h.Add(fmt.Sprintf("w%d", i))
+			}
+		}
+		got := float64(h.Count())
+		if math.Abs(got-float64(n)) > 4*stdError*float64(n)+1 {
+			t.Errorf("Count() = %v after adding %d distinct words", got, n)
+		}
+	}
+}
+
+// TestWithApproximation checks the queries of a network counting words
+// approximately against a network counting them exactly.
+func TestWithApproximation(t *testing.T) {
+	exact := newTestNetwork(t, 2, 1, 3)
+	defer exact.Close()
+	approximate := newTestNetwork(t, 2, 1, 3, WithApproximation(0.001, 0.01, 0.02))
+	defer approximate.Close()
+	total := uint(0)
+	for lineNo := uint(0); lineNo < 3000; lineNo++ {
+		line := fmt.Sprintf("TCP w%d w%d", lineNo%11, lineNo)
+		exact.Map(lineNo, line)
+		approximate.Map(lineNo, line)
+		total += 3
+	}
+
+	bound := uint(math.Ceil(0.001 * float64(total)))
+	for _, word := range []string{"TCP", "w3", "w2999", "UDP"} {
+		count, estimate := exact.Query(word), approximate.Query(word)
+		if estimate < count || estimate > count+bound {
+			t.Errorf("Query(%q) = %d, expected in [%d, %d]", word, estimate, count, count+bound)
+		}
+	}
+	distinct, estimate := exact.DistinctCount(), approximate.DistinctCount()
+	if distinct != 3001 {
+		t.Errorf("DistinctCount() = %d, expected 3001", distinct)
+	}
+	if math.Abs(float64(estimate)-float64(distinct)) > 0.08*float64(distinct) {
+		t.Errorf("DistinctCount() = %d, expected about %d", estimate, distinct)
+	}
+
+	if got := approximate.QueryAll(); len(got) != 0 {
+		t.Errorf("QueryAll() has %d words, expected none", len(got))
+	}
+	if got := approximate.TopK(3); len(got) != 0 {
+		t.Errorf("TopK(3) = %v, expected none", got)
+	}
+	if err := approximate.Snapshot(io.Discard); err == nil {
+		t.Errorf("Snapshot() returned a nil error")
+	}
+	if err := approximate.ScaleReducers(4); err == nil {
+		t.Errorf("ScaleReducers(4) returned a nil error")
+	}
+}
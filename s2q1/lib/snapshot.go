@@ -0,0 +1,75 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// snapshotVersion is the version of the snapshot format written by
+// writeSnapshot. It is increased whenever the format is changed in an
+// incompatible way, so that an old snapshot is not misread.
+const snapshotVersion = 1
+
+// The snapshot struct is the JSON format of a snapshot.
+// "Version" is the version of the format (see snapshotVersion).
+// "Reducers" contains the local dictionaries of the reducers, in no particular
+// order, since the reducers are visited concurrently. A reducer spilling to
+// disk writes its dictionary in more than one part (see WithSpill). Since a
+// word belongs to exactly one reducer, the dictionaries are simply added up
+// when the snapshot is restored, whatever their order and number are.
+//
+// Example:
+//
+//	{"version":1,"reducers":[{"TCP":14,"the":92},{"a":40}]}
+type snapshot struct {
+	Version  int               `json:"version"`
+	Reducers []map[string]uint `json:"reducers"`
+}
+
+// writeSnapshot writes the local dictionaries of all reducers of a word
+// counting network to w in the JSON snapshot format, in the order they are
+// visited.
+// The lines passed to the "map" function before the call are all counted.
+// It returns a non-nil error if the counting is approximate, since the words
+// are not kept.
+func writeSnapshot[R any](n *network[R, string, uint, uint], w io.Writer) error {
+	if n.approximate {
+		return fmt.Errorf("Approximate counts could not be snapshotted")
+	}
+	var mutex sync.Mutex
+	s := snapshot{Version: snapshotVersion}
+	n.visitAll(func(dictionary map[string]uint) {
+		local := make(map[string]uint, len(dictionary))
+		for word, count := range dictionary {
+			local[word] = count
+		}
+		mutex.Lock()
+		s.Reducers = append(s.Reducers, local)
+		mutex.Unlock()
+	}, nil)
+	return json.NewEncoder(w).Encode(&s)
+}
+
+// readSnapshot reads a snapshot in the JSON snapshot format from r, and adds
+// the counts in it to a word counting network. The words are sent to the
+// partitioners, so the network may have a different number of reducers, or
+// may already have counts of its own (which are merged with the snapshot).
+// It returns a non-nil error if the snapshot could not be read, in which case
+// the network is not changed.
+func readSnapshot[R any](n *network[R, string, uint, uint], r io.Reader) error {
+	var s snapshot
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return err
+	}
+	if s.Version != snapshotVersion {
+		return fmt.Errorf("Unsupported snapshot version: %d (expected %d)", s.Version, snapshotVersion)
+	}
+	for _, local := range s.Reducers {
+		for word, count := range local {
+			n.reduceValue(word, count)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+///////////
+// Tests //
+///////////
+
+// TestSnapshot checks that a snapshot could be restored to networks with
+// different numbers of reducers, and merged with the counts of a network.
+func TestSnapshot(t *testing.T) {
+	network := newTestNetwork(t, 2, 2, 3)
+	for lineNo := uint(0); lineNo < 100; lineNo++ {
+		network.Map(lineNo, fmt.Sprintf("TCP w%d", lineNo%10))
+	}
+	expected := network.QueryAll()
+	var buffer bytes.Buffer
+	if err := network.Snapshot(&buffer); err != nil {
+		t.Fatalf("Snapshot() = %v", err)
+	}
+	network.Close()
+	if !strings.HasPrefix(buffer.String(), `{"version":1,"reducers":[{`) {
+		t.Errorf("Snapshot() wrote %q", buffer.String())
+	}
+
+	for _, reducerCount := range []uint{1, 3, 7} {
+		g := newTestNetwork(t, 2, 1, reducerCount)
+		if err := g.Restore(bytes.NewReader(buffer.Bytes())); err != nil {
+			t.Errorf("Restore() = %v", err)
+		}
+		if got := g.QueryAll(); !reflect.DeepEqual(got, expected) {
+			t.Errorf("QueryAll() = %v after Restore() with %d reducers, expected %v", got, reducerCount, expected)
+		}
+		g.Map(0, "TCP UDP")
+		if err := g.Restore(bytes.NewReader(buffer.Bytes())); err != nil {
+			t.Errorf("Restore() = %v", err)
+		}
+		if got := g.Query("TCP"); got != 201 {
+			t.Errorf("Query(%q) = %d after merging, expected 201", "TCP", got)
+		}
+		if got := g.Query("UDP"); got != 1 {
+			t.Errorf("Query(%q) = %d after merging, expected 1", "UDP", got)
+		}
+		g.Close()
+	}
+}
+
+// TestRestoreOrder checks that restoring a snapshot does not depend on the
+// order and the number of the dictionaries in it.
+func TestRestoreOrder(t *testing.T) {
+	for _, s := range []string{
+		`{"version":1,"reducers":[{"TCP":2,"a":1},{"UDP":3}]}`,
+		`{"version":1,"reducers":[{"UDP":3},{"TCP":2,"a":1}]}`,
+		`{"version":1,"reducers":[{"UDP":1},{"a":1},{"TCP":2},{"UDP":2}]}`,
+	} {
+		network := newTestNetwork(t, 1, 1, 2)
+		if err := network.Restore(strings.NewReader(s)); err != nil {
+			t.Errorf("Restore(%q) = %v", s, err)
+		}
+		if got, expected := network.QueryAll(), map[string]uint{"TCP": 2, "UDP": 3, "a": 1}; !reflect.DeepEqual(got, expected) {
+			t.Errorf("QueryAll() = %v after Restore(%q), expected %v", got, s, expected)
+		}
+		network.Close()
+	}
+}
+
+// TestRestoreErrors checks that invalid snapshots are rejected.
+func TestRestoreErrors(t *testing.T) {
+	network := newTestNetwork(t, 1, 1, 1)
+	defer network.Close()
+	for _, s := range []string{
+		``,
+		`{"version":1,"reducers":[{"TCP":"x"}]}`,
+		`{"version":2,"reducers":[{"TCP":1}]}`,
+	} {
+		if err := network.Restore(strings.NewReader(s)); err == nil {
+			t.Errorf("Restore(%q) returns a nil error", s)
+		}
+	}
+	if got := network.Query("TCP"); got != 0 {
+		t.Errorf("Query(%q) = %d, expected 0", "TCP", got)
+	}
+}
@@ -0,0 +1,587 @@
+package lib
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+)
+
+const (
+	// entryOverhead is the estimated number of bytes taken by a word in a
+	// dictionary, besides the bytes of the word itself.
+	entryOverhead = 48
+	// runIndexInterval is the number of words between two entries of the
+	// index of a run.
+	runIndexInterval = 64
+	// maxRuns is the number of runs of a reducer after which they are merged
+	// into one.
+	maxRuns = 8
+)
+
+// The spill struct holds the settings of the reducers spilling to disk, set
+// by WithSpill.
+// "budget" is the number of bytes a reducer could take for its dictionary.
+// "dir" is the directory where the runs are written.
+type spill struct {
+	budget uint64
+	dir    string
+}
+
+// WithSpill returns an Option which bounds the memory taken by the dictionary
+// of each reducer to about "budget" bytes. When the dictionary exceeds the
+// budget, it is written to a temporary file in "dir" (or the default
+// directory for temporary files if "dir" is ""), sorted by word, and cleared.
+// Such a file is called a run. The queries merge the runs with the
+// dictionary, so the results are the same as without this option, and
+// vocabularies larger than memory could be counted.
+//
+// A query for a word reads one block of each run. The other queries read all
+// runs, so they are slower, and the queries which return all words (QueryAll
+// and Snapshot) still need the memory for all words. Delete, and Add with a
+// negative delta, write the new count of the word over its counts in the runs,
+// instead of reading the runs into memory. The runs of a reducer are merged
+// into one when there are more than 8 of them, and removed when the network
+// is closed. Only networks counting words exactly in this process
+// (NewNetwork and Setup, without WithRemoteReducers and WithApproximation)
+// support this option.
+func WithSpill(budget uint64, dir string) Option {
+	return func(c *config) {
+		c.spill = &spill{budget, dir}
+	}
+}
+
+// entrySize returns the estimated number of bytes taken by a word in a
+// dictionary.
+func entrySize(word string) uint64 {
+	return uint64(len(word)) + entryOverhead
+}
+
+// The tally struct is the count of a word in the dictionary or in a run of a
+// reducer spilling to disk.
+// "count" is the count of the word.
+// "replaced" is true if "count" replaces the counts of the word in the older
+// runs, instead of being added to them. It is set when the count is lowered
+// (such as by Delete, which keeps a "count" of 0 as a tombstone), since the
+// older runs could not be changed in place.
+type tally struct {
+	count    uint
+	replaced bool
+}
+
+// The runIndexEntry struct is an entry of the index of a run: a word in the
+// run, and the offset of its record in the file.
+type runIndexEntry struct {
+	word   string
+	offset int64
+}
+
+// The run struct is a file of words and their tallies, sorted by word. Each
+// record is the length of the word, the word and the tally, where the length
+// is an unsigned varint, and the tally is an unsigned varint of the count
+// shifted left by one bit, with "replaced" in the lowest bit.
+// "index" has an entry for every "runIndexInterval" records, so that a word is
+// found by reading at most "runIndexInterval" records.
+type run struct {
+	file  *os.File
+	size  int64
+	index []runIndexEntry
+}
+
+// writeRun writes a sequence of words and their tallies, which must be sorted
+// by word, to a new run in dir.
+func writeRun(dir string, words iter.Seq2[string, tally]) (*run, error) {
+	file, err := os.CreateTemp(dir, "s2q1-run-*")
+	if err != nil {
+		return nil, err
+	}
+	r := &run{file: file}
+	w := bufio.NewWriter(file)
+	var buffer [binary.MaxVarintLen64]byte
+	records := 0
+	for word, t := range words {
+		if records%runIndexInterval == 0 {
+			r.index = append(r.index, runIndexEntry{word, r.size})
+		}
+		n := binary.PutUvarint(buffer[:], uint64(len(word)))
+		w.Write(buffer[:n])
+		w.WriteString(word)
+		value := uint64(t.count) << 1
+		if t.replaced {
+			value |= 1
+		}
+		m := binary.PutUvarint(buffer[:], value)
+		w.Write(buffer[:m])
+		r.size += int64(n + len(word) + m)
+		records++
+	}
+	if err := w.Flush(); err != nil {
+		r.remove()
+		return nil, err
+	}
+	return r, nil
+}
+
+// remove closes and removes the file of a run.
+func (r *run) remove() error {
+	return errors.Join(r.file.Close(), os.Remove(r.file.Name()))
+}
+
+// records returns the records of a run from offset, in order. If a record
+// could not be read, the sequence ends, and the error is stored in *err.
+func (r *run) records(offset int64, err *error) iter.Seq2[string, tally] {
+	return func(yield func(string, tally) bool) {
+		reader := bufio.NewReader(io.NewSectionReader(r.file, offset, r.size-offset))
+		for {
+			length, e := binary.ReadUvarint(reader)
+			if e == io.EOF {
+				return
+			}
+			word := make([]byte, length)
+			if e == nil {
+				_, e = io.ReadFull(reader, word)
+			}
+			var value uint64
+			if e == nil {
+				value, e = binary.ReadUvarint(reader)
+			}
+			if e != nil {
+				*err = e
+				return
+			}
+			if !yield(string(word), tally{uint(value >> 1), value&1 == 1}) {
+				return
+			}
+		}
+	}
+}
+
+// lookup returns the tally of a word in a run, or a zero tally if it is not
+// in the run.
+func (r *run) lookup(word string) (tally, error) {
+	// i is the last index entry not after the word.
+	i := sort.Search(len(r.index), func(i int) bool { return r.index[i].word > word }) - 1
+	if i < 0 {
+		return tally{}, nil
+	}
+	var err error
+	for w, t := range r.records(r.index[i].offset, &err) {
+		if w >= word {
+			if w == word {
+				return t, nil
+			}
+			break
+		}
+	}
+	return tally{}, err
+}
+
+// sortedWords returns the words of a dictionary and their tallies, sorted by
+// word.
+func sortedWords(dictionary map[string]tally) iter.Seq2[string, tally] {
+	words := slices.Sorted(maps.Keys(dictionary))
+	return func(yield func(string, tally) bool) {
+		for _, word := range words {
+			if !yield(word, dictionary[word]) {
+				return
+			}
+		}
+	}
+}
+
+// counted returns the words and their counts as tallies which are added to
+// the older counts.
+func counted(words iter.Seq2[string, uint]) iter.Seq2[string, tally] {
+	return func(yield func(string, tally) bool) {
+		for word, count := range words {
+			if !yield(word, tally{count: count}) {
+				return
+			}
+		}
+	}
+}
+
+// The mergeCursor struct is the next word of a sequence being merged, and
+// the function returning the word after it.
+// "age" is the position of the sequence in the sequences merged, so that the
+// tallies of a word are resolved from the newest sequence.
+type mergeCursor struct {
+	word  string
+	tally tally
+	age   int
+	next  func() (string, tally, bool)
+}
+
+// The mergeHeap type is a min-heap of merge cursors, ordered by word, and
+// then by age.
+type mergeHeap []*mergeCursor
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	return h[i].word < h[j].word || h[i].word == h[j].word && h[i].age < h[j].age
+}
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x any)   { *h = append(*h, x.(*mergeCursor)) }
+func (h *mergeHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// mergeWords merges sequences of words and their tallies, each sorted by word
+// and ordered from the newest sequence, into one sequence of words and their
+// counts sorted by word. The counts of a word in more than one sequence are
+// added up, from the newest sequence to the first sequence where the tally of
+// the word is "replaced". The words whose counts are 0 (such as the words
+// deleted) are skipped. It takes O(n log k) time for k sequences.
+func mergeWords(sequences []iter.Seq2[string, tally]) iter.Seq2[string, uint] {
+	return func(yield func(string, uint) bool) {
+		var h mergeHeap
+		for age, sequence := range sequences {
+			next, stop := iter.Pull2(sequence)
+			defer stop()
+			if word, t, ok := next(); ok {
+				h = append(h, &mergeCursor{word, t, age, next})
+			}
+		}
+		heap.Init(&h)
+		for len(h) > 0 {
+			word, total, replaced := h[0].word, uint(0), false
+			for len(h) > 0 && h[0].word == word {
+				c := h[0]
+				if !replaced {
+					total += c.tally.count
+					replaced = c.tally.replaced
+				}
+				var ok bool
+				if c.word, c.tally, ok = c.next(); ok {
+					heap.Fix(&h, 0)
+				} else {
+					heap.Pop(&h)
+				}
+			}
+			if total > 0 && !yield(word, total) {
+				return
+			}
+		}
+	}
+}
+
+// spillReducerRoutine is the function executed instead of reducerRoutine
+// when the reducers spill to disk. It handles the same types of requests as
+// reducerRoutine, with a dictionary of bounded size and the runs spilled from
+// it:
+// (1) If the "Type" is MAP, the count is added to the dictionary. If the
+//     dictionary then exceeds the budget, it is written to a new run and
+//     cleared. If there are more than "maxRuns" runs, they are merged into
+//     one. A BATCH is handled as a MAP for each of its pairs;
+// (2) If the "Type" is QUERY, the counts of "key" in the dictionary and in
+//     the runs are added up and sent to "replyChannel";
+// (3) If the "Type" is QUERY_ALL, the dictionary and the runs are merged, and
+//     each word is sent to "replyChannel" like reducerRoutine does;
+// (4) If the "Type" is VISIT with a WordFilter, the words selected by the
+//     filter from the merged words are put into a dictionary, and "visit" is
+//     called with it. Since "visit" only reads the words selected by the
+//     filter, the result is the same as if it is called with all words. A
+//     keyed VISIT is handled in the same way, with only "key" selected. A
+//     VISIT without "visit" is only replied;
+// (5) If the "Type" is VISIT without a filter, the dictionary is spilled, and
+//     "visit" is called with each part of about the budget of the merged
+//     words, in order. The changes made by "visit" to a part (when the
+//     reducers are scaled) are then put into the dictionary, replacing the
+//     counts in the runs. A word added by "visit" is not seen by the later
+//     calls;
+// (6) If the "Type" is DISTINCT, the number of merged words is sent to
+//     "replyChannel" as "distinct";
+// (7) If the "Type" is ADD with a positive delta, the delta is added like (1);
+// (8) If the "Type" is ADD with a negative delta, or DELETE, the new count of
+//     the word is put into the dictionary, replacing its counts in the runs
+//     (a count of 0 is kept as a tombstone until the runs are merged). After
+//     (7) or (8), a result with "done" set to true is sent to "replyChannel";
+// (9) If the "Type" is RESET, the dictionary is cleared and the runs are
+//     removed, and a result with "done" set to true is sent to
+//     "replyChannel".
+// A run which could not be written or read is passed to "report" as a
+// StageError. The dictionary is then kept in memory if it could not be
+// written, and the words which could not be read are skipped.
+// The runs are removed when reducerChannel is closed.
+// The watchers in "ws" are notified like reducerRoutine does. The count of a
+// word watched is looked up in the runs before and after it is changed, so
+// changing it is slower.
+func spillReducerRoutine(
+	s spill,
+	ws *watchers[string, uint],
+	reducerChannel <-chan message[string, uint, uint],
+	syncChannel chan<- bool,
+	report func(error)) {
+
+	dictionary := make(map[string]tally)
+	size := uint64(0)
+	var runs []*run
+	// reading is true while the runs are read by a VISIT, so that they are
+	// not merged meanwhile.
+	reading := false
+	fail := func(err error) {
+		report(&StageError{Stage: "reducer", Input: "a run", Value: err})
+	}
+	// merged returns the words of the runs, and of the dictionary if
+	// withDictionary is true, merged and sorted by word.
+	merged := func(withDictionary bool, err *error) iter.Seq2[string, uint] {
+		var sequences []iter.Seq2[string, tally]
+		if withDictionary {
+			sequences = append(sequences, sortedWords(dictionary))
+		}
+		for _, r := range slices.Backward(runs) {
+			sequences = append(sequences, r.records(0, err))
+		}
+		return mergeWords(sequences)
+	}
+	// replaceRuns removes the runs, and keeps the runs in rs instead.
+	replaceRuns := func(rs ...*run) {
+		for _, r := range runs {
+			if err := r.remove(); err != nil {
+				fail(err)
+			}
+		}
+		runs = rs
+	}
+	// spillDictionary writes the dictionary to a new run, and merges the
+	// runs if there are too many and they are not being read.
+	spillDictionary := func() {
+		r, err := writeRun(s.dir, sortedWords(dictionary))
+		if err != nil {
+			fail(err)
+			return
+		}
+		runs = append(runs, r)
+		clear(dictionary)
+		size = 0
+		if len(runs) > maxRuns && !reading {
+			var readErr error
+			r, err := writeRun(s.dir, counted(merged(false, &readErr)))
+			if err == nil && readErr != nil {
+				err = readErr
+				r.remove()
+			}
+			if err != nil {
+				fail(err)
+				return
+			}
+			replaceRuns(r)
+		}
+	}
+	// total returns the count of a word in the dictionary and in the runs,
+	// from the newest to the first tally which is "replaced".
+	total := func(word string) uint {
+		t, ok := dictionary[word]
+		count := t.count
+		if ok && t.replaced {
+			return count
+		}
+		for _, r := range slices.Backward(runs) {
+			t, err := r.lookup(word)
+			if err != nil {
+				fail(err)
+			}
+			count += t.count
+			if t.replaced {
+				break
+			}
+		}
+		return count
+	}
+	// addCount adds a count to the dictionary, and spills it if it exceeds
+	// the budget.
+	addCount := func(word string, count uint) {
+		if ws.watching(word) {
+			old := total(word)
+			defer ws.changed(word, old, old+count, report)
+		}
+		t, ok := dictionary[word]
+		if !ok {
+			size += entrySize(word)
+		}
+		t.count += count
+		dictionary[word] = t
+		if size > s.budget {
+			spillDictionary()
+		}
+	}
+	// set sets the count of a word in the dictionary, replacing its counts in
+	// the runs, and spills the dictionary if it exceeds the budget. Without
+	// runs, a word whose count is 0 is simply removed.
+	set := func(word string, count uint) {
+		_, ok := dictionary[word]
+		if len(runs) == 0 && count == 0 {
+			if ok {
+				delete(dictionary, word)
+				size -= entrySize(word)
+			}
+			return
+		}
+		if !ok {
+			size += entrySize(word)
+		}
+		dictionary[word] = tally{count, len(runs) > 0}
+		if size > s.budget {
+			spillDictionary()
+		}
+	}
+	// change sets the count of a word to the count returned by f with its
+	// current count, and notifies the watchers matching the word.
+	change := func(word string, f func(old uint) uint) {
+		old := total(word)
+		if count := f(old); count != old {
+			set(word, count)
+			ws.changed(word, old, count, report)
+		}
+	}
+	// visitParts calls visit with each part of the merged words, and puts
+	// the changes made by visit into the dictionary (see (5) above). It is
+	// called at least once, even if there are no words.
+	visitParts := func(visit func(map[string]uint)) {
+		if len(dictionary) > 0 {
+			spillDictionary()
+		}
+		reading = true
+		part, partSize := make(map[string]uint), uint64(0)
+		visitPart := func() {
+			before := maps.Clone(part)
+			protect("reducer", visitInput, report, func() {
+				visit(part)
+			})
+			for word, count := range before {
+				if c, ok := part[word]; !ok {
+					set(word, 0)
+				} else if c != count {
+					set(word, c)
+				}
+			}
+			for word, count := range part {
+				if _, ok := before[word]; !ok {
+					set(word, count)
+				}
+			}
+			clear(part)
+			partSize = 0
+		}
+		var err error
+		for word, count := range merged(false, &err) {
+			part[word] = count
+			partSize += entrySize(word)
+			if partSize > s.budget {
+				visitPart()
+			}
+		}
+		if err != nil {
+			fail(err)
+		}
+		visitPart()
+		reading = false
+		if size > s.budget {
+			spillDictionary()
+		}
+	}
+	for msg := range reducerChannel {
+		switch msg.Type {
+		case MAP, BATCH:
+			msg.each(addCount)
+		case QUERY:
+			msg.reply(result[string, uint]{key: msg.key, value: total(msg.key)})
+		case QUERY_ALL:
+			var err error
+			for word, count := range merged(true, &err) {
+				if !msg.reply(result[string, uint]{key: word, value: count}) {
+					break
+				}
+			}
+			if err != nil {
+				fail(err)
+			}
+			msg.reply(result[string, uint]{done: true})
+		case VISIT:
+			if msg.visit == nil {
+				// A barrier is only replied (see barrier).
+			} else if msg.keyed {
+				selected := make(map[string]uint)
+				if count := total(msg.key); count > 0 {
+					selected[msg.key] = count
+				}
+				protect("reducer", visitInput, report, func() {
+					msg.visit(selected)
+				})
+			} else if filter, ok := msg.filter.(WordFilter); ok {
+				var err error
+				selected := make(map[string]uint)
+				for _, wc := range filter.apply(merged(true, &err)) {
+					selected[wc.Word] = wc.Count
+				}
+				if err != nil {
+					fail(err)
+				}
+				protect("reducer", visitInput, report, func() {
+					msg.visit(selected)
+				})
+			} else {
+				visitParts(msg.visit)
+			}
+			msg.reply(result[string, uint]{done: true})
+		case DISTINCT:
+			var err error
+			distinct := uint(0)
+			for range merged(true, &err) {
+				distinct++
+			}
+			if err != nil {
+				fail(err)
+			}
+			msg.reply(result[string, uint]{distinct: distinct})
+			msg.reply(result[string, uint]{done: true})
+		case ADD:
+			if msg.delta >= 0 {
+				addCount(msg.key, uint(msg.delta))
+			} else {
+				change(msg.key, func(old uint) uint {
+					count, _, err := addDelta(old, msg.delta)
+					if err != nil {
+						report(&StageError{Stage: "reducer", Input: keyInput(msg.key)(), Value: err})
+						return old
+					}
+					return count
+				})
+			}
+			msg.reply(result[string, uint]{done: true})
+		case DELETE:
+			change(msg.key, func(uint) uint {
+				return 0
+			})
+			msg.reply(result[string, uint]{done: true})
+		case RESET:
+			if len(ws.load()) > 0 {
+				var err error
+				for word, count := range merged(true, &err) {
+					ws.changed(word, count, 0, report)
+				}
+				if err != nil {
+					fail(err)
+				}
+			}
+			clear(dictionary)
+			size = 0
+			replaceRuns()
+			msg.reply(result[string, uint]{done: true})
+		default:
+			panic(fmt.Sprintf("Unknown case: %d", msg.Type))
+		}
+	}
+	replaceRuns()
+	syncChannel <- true
+}
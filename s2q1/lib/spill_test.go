@@ -0,0 +1,164 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"iter"
+	"maps"
+	"os"
+	"reflect"
+	"testing"
+)
+
+///////////
+// Tests //
+///////////
+
+// TestRun checks that the words written to a run are read back in order, and
+// that each of them, and no other word, is found by lookup.
+func TestRun(t *testing.T) {
+	dictionary := make(map[string]tally)
+	for i := uint(0); i < 300; i++ {
+		dictionary[fmt.Sprintf("w%04d", i*2)] = tally{i, i%3 == 0}
+	}
+	r, err := writeRun(t.TempDir(), sortedWords(dictionary))
+	if err != nil {
+		t.Fatalf("writeRun() returned %v", err)
+	}
+	defer r.remove()
+
+	var readErr error
+	if got := maps.Collect(r.records(0, &readErr)); !reflect.DeepEqual(got, dictionary) || readErr != nil {
+		t.Errorf("records() returned %d words and %v, expected %d words", len(got), readErr, len(dictionary))
+	}
+	for i := uint(0); i < 600; i++ {
+		word := fmt.Sprintf("w%04d", i)
+		if got, err := r.lookup(word); got != dictionary[word] || err != nil {
+			t.Errorf("lookup(%q) = %+v, %v, expected %+v", word, got, err, dictionary[word])
+		}
+	}
+	for _, word := range []string{"", "a", "w", "z"} {
+		if got, err := r.lookup(word); got != (tally{}) || err != nil {
+			t.Errorf("lookup(%q) = %+v, %v, expected a zero tally", word, got, err)
+		}
+	}
+}
+
+// TestMergeWords checks the function mergeWords() with predefined test cases.
+func TestMergeWords(t *testing.T) {
+	// The dictionaries are ordered from the newest.
+	cases := []struct {
+		dictionaries []map[string]tally
+		expected     []WordCount
+	}{
+		{nil, nil},
+		{[]map[string]tally{{}}, nil},
+		{[]map[string]tally{{"b": {1, false}, "a": {2, false}}}, []WordCount{{"a", 2}, {"b", 1}}},
+		{[]map[string]tally{{"a": {1, false}, "c": {1, false}}, {"b": {2, false}}, {"a": {3, false}, "d": {4, false}}}, []WordCount{{"a", 4}, {"b", 2}, {"c", 1}, {"d", 4}}},
+		{[]map[string]tally{{"a": {0, true}, "b": {1, true}}, {"a": {3, false}, "b": {5, false}}}, []WordCount{{"b", 1}}},
+		{[]map[string]tally{{"a": {2, false}}, {"a": {1, true}}, {"a": {3, false}}}, []WordCount{{"a", 3}}},
+		{[]map[string]tally{{"a": {0, false}, "b": {0, true}}, {"c": {0, true}}}, nil},
+	}
+	for _, c := range cases {
+		var sequences []iter.Seq2[string, tally]
+		for _, dictionary := range c.dictionaries {
+			sequences = append(sequences, sortedWords(dictionary))
+		}
+		var got []WordCount
+		for word, count := range mergeWords(sequences) {
+			got = append(got, WordCount{word, count})
+		}
+		if !equalWordCounts(got, c.expected) {
+			t.Errorf("mergeWords(%v) = %v, expected %v", c.dictionaries, got, c.expected)
+		}
+	}
+}
+
+// TestWithSpill checks the queries of a network spilling to disk against a
+// network keeping the dictionaries in memory, and that the runs are removed
+// when the network is closed.
+func TestWithSpill(t *testing.T) {
+	dir := t.TempDir()
+	exact := newTestNetwork(t, 2, 1, 3)
+	defer exact.Close()
+	// A budget of 1000 bytes holds about 18 words.
+	spilled := newTestNetwork(t, 2, 1, 3, WithSpill(1000, dir))
+	for lineNo := uint(0); lineNo < 2000; lineNo++ {
+		line := fmt.Sprintf("TCP w%d x%d", lineNo%700, lineNo%13)
+		exact.Map(lineNo, line)
+		spilled.Map(lineNo, line)
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) == 0 {
+		t.Errorf("No runs are written to %s", dir)
+	}
+	for _, word := range []string{"TCP", "w0", "w699", "x12", "UDP"} {
+		if got, expected := spilled.Query(word), exact.Query(word); got != expected {
+			t.Errorf("Query(%q) = %d, expected %d", word, got, expected)
+		}
+	}
+	if got, expected := spilled.QueryAll(), exact.QueryAll(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("QueryAll() has %d words, expected %d", len(got), len(expected))
+	}
+	if got, expected := spilled.TopK(5), exact.TopK(5); !equalWordCounts(got, expected) {
+		t.Errorf("TopK(5) = %v, expected %v", got, expected)
+	}
+	if got, expected := spilled.Prefix("w69"), exact.Prefix("w69"); !equalWordCounts(got, expected) {
+		t.Errorf("Prefix(%q) = %v, expected %v", "w69", got, expected)
+	}
+	if got := spilled.DistinctCount(); got != 714 {
+		t.Errorf("DistinctCount() = %d, expected 714", got)
+	}
+
+	// The changes are written over the runs, instead of rewriting them.
+	runs, _ := os.ReadDir(dir)
+	for _, network := range []*Network{exact, spilled} {
+		network.Delete("w1")
+		network.Add("w2", -1)
+		network.Add("TCP", -1000)
+		network.Map(2000, "w1 x3")
+	}
+	for _, word := range []string{"TCP", "w1", "w2", "x3"} {
+		if got, expected := spilled.Query(word), exact.Query(word); got != expected {
+			t.Errorf("Query(%q) = %d after the changes, expected %d", word, got, expected)
+		}
+	}
+	if got, expected := spilled.QueryAll(), exact.QueryAll(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("QueryAll() has %d words after the changes, expected %d", len(got), len(expected))
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) < len(runs) {
+		t.Errorf("%d runs are left after the changes, expected at least %d", len(entries), len(runs))
+	}
+
+	var snapshot bytes.Buffer
+	if err := spilled.Snapshot(&snapshot); err != nil {
+		t.Fatalf("Snapshot() = %v", err)
+	}
+	restored := newTestNetwork(t, 1, 1, 2)
+	defer restored.Close()
+	if err := restored.Restore(&snapshot); err != nil {
+		t.Fatalf("Restore() = %v", err)
+	}
+	if got, expected := restored.QueryAll(), exact.QueryAll(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("QueryAll() has %d words after Restore(), expected %d", len(got), len(expected))
+	}
+	if err := spilled.ScaleReducers(5); err != nil {
+		t.Fatalf("ScaleReducers(5) = %v", err)
+	}
+	spilled.Map(2001, "TCP")
+	exact.Map(2001, "TCP")
+	if got, expected := spilled.QueryAll(), exact.QueryAll(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("QueryAll() has %d words after scaling, expected %d", len(got), len(expected))
+	}
+	if got, expected := spilled.Query("TCP"), exact.Query("TCP"); got != expected {
+		t.Errorf("Query(%q) = %d after scaling, expected %d", "TCP", got, expected)
+	}
+	if err := spilled.Err(); err != nil {
+		t.Errorf("Err() = %v", err)
+	}
+
+	spilled.Close()
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("%d runs are left in %s after Close()", len(entries), dir)
+	}
+}
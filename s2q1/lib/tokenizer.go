@@ -0,0 +1,148 @@
+package lib
+
+import (
+	"bufio"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The Tokenizer struct describes how a line is split into tokens (words), and
+// how the tokens are normalized before they are counted. The stages are
+// applied in the order of the fields. The zero value splits a line with
+// bufio.ScanWords and keeps the tokens as is.
+// "Split" is the function used to split a line into tokens. If it is nil,
+// bufio.ScanWords is used.
+// "FoldCase" tells whether the tokens are case folded (converted to lower
+// case), so that "TCP" and "tcp" are the same token.
+// "StripPunctuation" tells whether the leading and trailing punctuations are
+// removed, so that "TCP," and "TCP" are the same token. Punctuations inside a
+// token (such as "three-way") are kept.
+// "StopWords" contains the tokens to be dropped. The tokens are looked up
+// after case folding and punctuation stripping.
+// "Stem" is the stemming function. If it is not nil, it is called for each
+// token which is not dropped, and its result is used instead.
+type Tokenizer struct {
+	Split            bufio.SplitFunc
+	FoldCase         bool
+	StripPunctuation bool
+	StopWords        map[string]bool
+	Stem             func(string) string
+}
+
+// Tokenize splits a line into tokens and calls emit once for each token.
+// "offset" is the position of the token in the line, counting the tokens
+// dropped as well, so that it is the same whatever stop words are used.
+func (t Tokenizer) Tokenize(line string, emit func(token string, offset uint)) {
+	split := t.Split
+	if split == nil {
+		split = bufio.ScanWords
+	}
+	reader := strings.NewReader(line)
+	scanner := bufio.NewScanner(reader)
+	scanner.Split(split)
+	for offset := uint(0); scanner.Scan(); offset++ {
+		if token, ok := t.Normalize(scanner.Text()); ok {
+			emit(token, offset)
+		}
+	}
+}
+
+// Normalize applies the normalization stages (all stages except "Split") to
+// a token. It returns the normalized token and true, or "" and false if the
+// token is dropped. It is also useful for normalizing a word to be queried,
+// so that query("TCP") finds "tcp" when "FoldCase" is set.
+func (t Tokenizer) Normalize(token string) (string, bool) {
+	if t.FoldCase {
+		token = strings.ToLower(token)
+	}
+	if t.StripPunctuation {
+		token = strings.TrimFunc(token, unicode.IsPunct)
+	}
+	if token == "" || t.StopWords[token] {
+		return "", false
+	}
+	if t.Stem != nil {
+		token = t.Stem(token)
+	}
+	return token, true
+}
+
+// CountTokens returns the Mapper used for counting words split by the
+// Tokenizer. It emits each token with a count of 1.
+func CountTokens(t Tokenizer) Mapper[string, string, uint] {
+	return func(lineNo uint, line string, emit func(string, uint)) {
+		t.Tokenize(line, func(token string, offset uint) {
+			emit(token, 1)
+		})
+	}
+}
+
+// IndexTokens returns the Mapper used for building an inverted index of the
+// words split by the Tokenizer. It emits each token with its Posting.
+func IndexTokens(t Tokenizer) Mapper[string, string, Posting] {
+	return func(lineNo uint, line string, emit func(string, Posting)) {
+		t.Tokenize(line, func(token string, offset uint) {
+			emit(token, Posting{lineNo, offset})
+		})
+	}
+}
+
+// ScanAlphanumeric is a split function for a bufio.Scanner that returns each
+// run of letters and digits as a token. Any other rune separates tokens, so
+// "three-way" is split into "three" and "way".
+func ScanAlphanumeric(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	isAlphanumeric := func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r)
+	}
+
+	// Skip leading separators.
+	start := 0
+	for start < len(data) {
+		r, width := utf8.DecodeRune(data[start:])
+		if isAlphanumeric(r) {
+			break
+		}
+		start += width
+	}
+
+	// Scan until a separator, marking end of token.
+	for i := start; i < len(data); {
+		r, width := utf8.DecodeRune(data[i:])
+		if !isAlphanumeric(r) {
+			return i + width, data[start:i], nil
+		}
+		i += width
+	}
+
+	// If we're at EOF, we have a final, non-empty, non-terminated token.
+	if atEOF && len(data) > start {
+		return len(data), data[start:], nil
+	}
+
+	// Request more data.
+	return start, nil, nil
+}
+
+// englishSuffixes are the suffixes removed by StemEnglish, longest first.
+var englishSuffixes = []string{"ings", "ing", "edly", "ed", "ies", "es", "s"}
+
+// StemEnglish is a simple stemming function for English words. It removes one
+// common inflectional suffix (such as "-s", "-ed" and "-ing"), provided that
+// at least 3 letters remain, so that "handshakes" becomes "handshake" and
+// "connecting" becomes "connect". It is not a full Porter stemmer, but it
+// shows how a stemming function is plugged into a Tokenizer.
+func StemEnglish(word string) string {
+	for _, suffix := range englishSuffixes {
+		if stem, ok := strings.CutSuffix(word, suffix); ok && utf8.RuneCountInString(stem) >= 3 {
+			if suffix == "ies" {
+				return stem + "y"
+			}
+			if suffix == "es" && !strings.HasSuffix(stem, "s") && !strings.HasSuffix(stem, "x") && !strings.HasSuffix(stem, "ch") && !strings.HasSuffix(stem, "sh") {
+				return stem + "e"
+			}
+			return stem
+		}
+	}
+	return word
+}
@@ -0,0 +1,79 @@
+package lib
+
+import (
+	"bufio"
+	"reflect"
+	"testing"
+)
+
+///////////
+// Tests //
+///////////
+
+// TestTokenize checks the method Tokenizer.Tokenize() with predefined test cases.
+func TestTokenize(t *testing.T) {
+	cases := []struct {
+		tokenizer Tokenizer
+		line      string
+		expected  []string
+		offsets   []uint
+	}{
+		{Tokenizer{}, "TCP, tcp (TCP)", []string{"TCP,", "tcp", "(TCP)"}, []uint{0, 1, 2}},
+		{Tokenizer{FoldCase: true}, "TCP, tcp (TCP)", []string{"tcp,", "tcp", "(tcp)"}, []uint{0, 1, 2}},
+		{Tokenizer{StripPunctuation: true}, "TCP, tcp (TCP) -- three-way", []string{"TCP", "tcp", "TCP", "three-way"}, []uint{0, 1, 2, 4}},
+		{Tokenizer{FoldCase: true, StripPunctuation: true, StopWords: map[string]bool{"the": true}}, "The TCP handshake, the end.", []string{"tcp", "handshake", "end"}, []uint{1, 2, 4}},
+		{Tokenizer{Stem: StemEnglish}, "connecting handshakes", []string{"connect", "handshake"}, []uint{0, 1}},
+		{Tokenizer{Split: ScanAlphanumeric}, "three-way (TCP)", []string{"three", "way", "TCP"}, []uint{0, 1, 2}},
+		{Tokenizer{Split: bufio.ScanRunes}, "ab c", []string{"a", "b", " ", "c"}, []uint{0, 1, 2, 3}},
+	}
+	for _, c := range cases {
+		var got []string
+		var offsets []uint
+		c.tokenizer.Tokenize(c.line, func(token string, offset uint) {
+			got = append(got, token)
+			offsets = append(offsets, offset)
+		})
+		if !reflect.DeepEqual(got, c.expected) || !reflect.DeepEqual(offsets, c.offsets) {
+			t.Errorf("%+v.Tokenize(%q) emitted %q at %v, expected %q at %v", c.tokenizer, c.line, got, offsets, c.expected, c.offsets)
+		}
+	}
+}
+
+// TestStemEnglish checks the function StemEnglish() with predefined test cases.
+func TestStemEnglish(t *testing.T) {
+	cases := []struct {
+		word     string
+		expected string
+	}{
+		{"TCP", "TCP"},
+		{"uses", "use"},
+		{"handshakes", "handshake"},
+		{"boxes", "box"},
+		{"passes", "pass"},
+		{"replies", "reply"},
+		{"connected", "connect"},
+		{"connecting", "connect"},
+		{"is", "is"},
+		{"bed", "bed"},
+	}
+	for _, c := range cases {
+		if got := StemEnglish(c.word); got != c.expected {
+			t.Errorf("StemEnglish(%q) = %q, expected %q", c.word, got, c.expected)
+		}
+	}
+}
+
+// TestWithTokenizer checks that the Tokenizer set by WithTokenizer() is used
+// by the network returned by Setup().
+func TestWithTokenizer(t *testing.T) {
+	tokenizer := Tokenizer{FoldCase: true, StripPunctuation: true}
+	mapFunc, query, _, shutdown := Setup(2, 2, 2, WithTokenizer(tokenizer))
+	defer shutdown()
+	mapFunc(0, "TCP, tcp and (TCP).")
+	if got := query("tcp"); got != 3 {
+		t.Errorf("query(%q) = %d, expected 3", "tcp", got)
+	}
+	if got := query("TCP"); got != 0 {
+		t.Errorf("query(%q) = %d, expected 0", "TCP", got)
+	}
+}
@@ -0,0 +1,171 @@
+package lib
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// The watcher struct is a subscription to the changes of the values of some
+// keys, registered by Network.Watch.
+// "match" tells whether the changes of a key are watched.
+// "notify" is called by the reducer goroutine keeping a key matched, with the
+// old and the new value, after the value is changed.
+// "stop" cancels the subscription.
+type watcher[K comparable, A any] struct {
+	match  func(key K) bool
+	notify func(key K, old, value A)
+	stop   func()
+}
+
+// The watchers struct holds the watchers of a network, shared by all reducer
+// goroutines, including those added when the reducers are scaled. "list" is
+// replaced, instead of modified, when a watcher is added or removed, so that
+// the reducers read it without locking. "mutex" serializes the replacements.
+// The methods could be called with a nil *watchers, which has no watchers.
+type watchers[K comparable, A any] struct {
+	mutex sync.Mutex
+	list  atomic.Pointer[[]*watcher[K, A]]
+}
+
+// load returns the current watchers.
+func (ws *watchers[K, A]) load() []*watcher[K, A] {
+	if ws == nil {
+		return nil
+	}
+	if list := ws.list.Load(); list != nil {
+		return *list
+	}
+	return nil
+}
+
+// add registers a watcher.
+func (ws *watchers[K, A]) add(w *watcher[K, A]) {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	list := append(slices.Clone(ws.load()), w)
+	ws.list.Store(&list)
+}
+
+// remove unregisters a watcher. It has no effect if the watcher is not
+// registered.
+func (ws *watchers[K, A]) remove(w *watcher[K, A]) {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	list := slices.DeleteFunc(slices.Clone(ws.load()), func(x *watcher[K, A]) bool {
+		return x == w
+	})
+	ws.list.Store(&list)
+}
+
+// stopAll cancels all watchers.
+func (ws *watchers[K, A]) stopAll() {
+	for _, w := range ws.load() {
+		w.stop()
+	}
+}
+
+// watching returns whether the changes of a key are watched by any watcher.
+func (ws *watchers[K, A]) watching(key K) bool {
+	for _, w := range ws.load() {
+		if w.match(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// changed notifies the watchers matching a key that its value is changed
+// from old to value. It is called by the reducer goroutine keeping the key.
+// If "notify" panics, such as when the channel of the updates is closed, the
+// panic is passed to "report" as a StageError.
+func (ws *watchers[K, A]) changed(key K, old, value A, report func(error)) {
+	for _, w := range ws.load() {
+		if w.match(key) {
+			protect("reducer", keyInput(key), report, func() {
+				w.notify(key, old, value)
+			})
+		}
+	}
+}
+
+// The Watch struct describes the words watched by Network.Watch, and when
+// their updates are sent.
+// "Words" and "Prefix" are the words watched: a word is watched if it is one
+// of "Words", or if it starts with "Prefix" (when "Prefix" is not ""). If both
+// are empty, all words are watched.
+// "Threshold" is the count to be crossed. If it is 0, an update is sent every
+// time the count of a word watched changes; Otherwise, an update is sent only
+// when the count reaches "Threshold" from below, or falls below it again
+// (such as by Add or Unmap).
+type Watch struct {
+	Words     []string
+	Prefix    string
+	Threshold uint
+}
+
+// matcher returns the function telling whether a word is watched.
+func (w Watch) matcher() func(word string) bool {
+	words := make(map[string]bool, len(w.Words))
+	for _, word := range w.Words {
+		words[word] = true
+	}
+	all := len(w.Words) == 0 && w.Prefix == ""
+	return func(word string) bool {
+		return all || words[word] || w.Prefix != "" && strings.HasPrefix(word, w.Prefix)
+	}
+}
+
+// crossed returns whether a change of a count from old to count is sent as an
+// update.
+func (w Watch) crossed(old, count uint) bool {
+	if w.Threshold == 0 {
+		return old != count
+	}
+	return (old < w.Threshold) != (count < w.Threshold)
+}
+
+// watch registers a watcher sending the updates described by w to updates,
+// and returns the function canceling it. The records passed to mapFunc before
+// the call are all counted before the watcher is registered.
+//
+// An update is sent by the reducer goroutine keeping the word, which waits
+// until the update is received or the watcher is canceled, so that the updates
+// of a word are sent in order and none is lost.
+func watch[R any, V any](n *network[R, string, V, uint], w Watch, updates chan<- WordCount) func() {
+	n.barrier()
+
+	var mutex sync.Mutex
+	canceled := false
+	done := make(chan struct{})
+	wr := &watcher[string, uint]{match: w.matcher()}
+	wr.notify = func(word string, old, count uint) {
+		if !w.crossed(old, count) {
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if canceled {
+			return
+		}
+		select {
+		case updates <- WordCount{word, count}:
+		case <-done:
+		}
+	}
+	var once sync.Once
+	wr.stop = func() {
+		once.Do(func() {
+			// Closing "done" releases a reducer waiting to send an update,
+			// so that the lock could be taken.
+			close(done)
+			mutex.Lock()
+			canceled = true
+			mutex.Unlock()
+			n.watchers.remove(wr)
+		})
+	}
+	n.watchers.add(wr)
+	return wr.stop
+}
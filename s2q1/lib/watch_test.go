@@ -0,0 +1,165 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+///////////
+// Tests //
+///////////
+
+// TestWatchMatcher checks which words are watched by a Watch, and which
+// changes of their counts are sent as updates, with predefined test cases.
+func TestWatchMatcher(t *testing.T) {
+	matchCases := []struct {
+		w        Watch
+		word     string
+		expected bool
+	}{
+		{Watch{}, "TCP", true},
+		{Watch{Words: []string{"TCP", "UDP"}}, "UDP", true},
+		{Watch{Words: []string{"TCP", "UDP"}}, "TC", false},
+		{Watch{Prefix: "TC"}, "TCP", true},
+		{Watch{Prefix: "TC"}, "UDP", false},
+		{Watch{Words: []string{"UDP"}, Prefix: "TC"}, "UDP", true},
+	}
+	for _, c := range matchCases {
+		if got := c.w.matcher()(c.word); got != c.expected {
+			t.Errorf("%+v matches %q = %t, expected %t", c.w, c.word, got, c.expected)
+		}
+	}
+
+	crossedCases := []struct {
+		threshold, old, count uint
+		expected              bool
+	}{
+		{0, 0, 1, true},
+		{0, 4, 4, false},
+		{0, 5, 2, true},
+		{3, 1, 2, false},
+		{3, 2, 3, true},
+		{3, 0, 9, true},
+		{3, 3, 4, false},
+		{3, 4, 2, true},
+		{3, 4, 0, true},
+	}
+	for _, c := range crossedCases {
+		w := Watch{Threshold: c.threshold}
+		if got := w.crossed(c.old, c.count); got != c.expected {
+			t.Errorf("Watch{Threshold: %d}.crossed(%d, %d) = %t, expected %t", c.threshold, c.old, c.count, got, c.expected)
+		}
+	}
+}
+
+// receiveUpdates returns the updates waiting in a channel.
+func receiveUpdates(updates <-chan WordCount) []WordCount {
+	var wcs []WordCount
+	for {
+		select {
+		case wc := <-updates:
+			wcs = append(wcs, wc)
+		default:
+			return wcs
+		}
+	}
+}
+
+// TestWatch checks the updates sent to the watchers of networks with the
+// reducers in memory and spilling to disk, while the words are mapped,
+// changed, and moved by ScaleReducers.
+func TestWatch(t *testing.T) {
+	cases := []struct {
+		name    string
+		options []Option
+	}{
+		{"memory", nil},
+		{"spill", []Option{WithSpill(200, t.TempDir())}},
+	}
+	for _, c := range cases {
+		network := newTestNetwork(t, 2, 2, 3, c.options...)
+		network.Map(0, "TCP w1")
+		tcpUpdates := make(chan WordCount, 100)
+		cancelTCP, err := network.Watch(Watch{Words: []string{"TCP"}}, tcpUpdates)
+		if err != nil {
+			t.Fatalf("%s: Watch() returned %v", c.name, err)
+		}
+		thresholdUpdates := make(chan WordCount, 100)
+		cancelThreshold, err := network.Watch(Watch{Prefix: "w", Threshold: 3}, thresholdUpdates)
+		if err != nil {
+			t.Fatalf("%s: Watch() returned %v", c.name, err)
+		}
+
+		for lineNo := uint(1); lineNo < 40; lineNo++ {
+			network.Map(lineNo, fmt.Sprintf("TCP w%d x%d", lineNo%3, lineNo))
+		}
+		network.ScaleReducers(5)
+		network.Map(40, "TCP w1")
+		network.Add("TCP", -38)
+		network.Delete("w2")
+		network.Flush()
+
+		var expected []WordCount
+		for count := uint(2); count <= 41; count++ {
+			expected = append(expected, WordCount{"TCP", count})
+		}
+		expected = append(expected, WordCount{"TCP", 3})
+		if got := receiveUpdates(tcpUpdates); !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: the updates of %q are %v, expected %v", c.name, "TCP", got, expected)
+		}
+		got := make(map[string][]uint)
+		for _, wc := range receiveUpdates(thresholdUpdates) {
+			got[wc.Word] = append(got[wc.Word], wc.Count)
+		}
+		if expected := map[string][]uint{"w0": {3}, "w1": {3}, "w2": {3, 0}}; !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: the updates of the threshold are %v, expected %v", c.name, got, expected)
+		}
+
+		cancelTCP()
+		cancelTCP()
+		network.Map(41, "TCP")
+		network.Reset()
+		if got := receiveUpdates(tcpUpdates); len(got) != 0 {
+			t.Errorf("%s: the updates of %q after canceling are %v, expected none", c.name, "TCP", got)
+		}
+		got = make(map[string][]uint)
+		for _, wc := range receiveUpdates(thresholdUpdates) {
+			got[wc.Word] = append(got[wc.Word], wc.Count)
+		}
+		if expected := map[string][]uint{"w0": {0}, "w1": {0}}; !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: the updates of the threshold after Reset() are %v, expected %v", c.name, got, expected)
+		}
+		cancelThreshold()
+		if err := network.Err(); err != nil {
+			t.Errorf("%s: Err() = %v, expected nil", c.name, err)
+		}
+		network.Close()
+	}
+}
+
+// TestWatchClose checks that closing a network is not held up by a watcher
+// whose updates are not received, and that the watchers of remote or
+// approximate reducers are rejected.
+func TestWatchClose(t *testing.T) {
+	network := newTestNetwork(t, 1, 1, 1)
+	cancel, err := network.Watch(Watch{}, make(chan WordCount))
+	if err != nil {
+		t.Fatalf("Watch() returned %v", err)
+	}
+	network.Map(0, "TCP UDP")
+	ctx, ctxCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer ctxCancel()
+	if err := network.CloseContext(ctx); err != nil {
+		t.Errorf("CloseContext() = %v, expected nil", err)
+	}
+	cancel()
+
+	approximate := newTestNetwork(t, 1, 1, 1, WithApproximation(0.001, 0.01, 0.02))
+	defer approximate.Close()
+	if _, err := approximate.Watch(Watch{}, make(chan WordCount)); err == nil {
+		t.Errorf("Watch() returned a nil error when the counting is approximate")
+	}
+}
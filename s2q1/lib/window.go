@@ -0,0 +1,326 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The Window struct describes the windows counted by a Windowed network.
+// The positions of the lines are their line numbers, or the times they are
+// mapped (in nanoseconds since the Unix epoch) if "Time" is true.
+// "Size" is the length of a window, in lines or in nanoseconds.
+// "Slide" is the distance between the starts of two consecutive windows. If
+// it is 0 or "Size", the windows are tumbling (they do not overlap);
+// Otherwise, they are sliding, and "Size" must be a multiple of "Slide".
+// "Time" tells whether the windows are measured in time instead of lines.
+// "Retain" is the number of past windows kept to be queried, besides the
+// current one. The past windows are "Slide" apart, so a sliding window of 60
+// seconds sliding every 10 seconds with a "Retain" of 6 could be queried as it
+// was up to a minute ago.
+//
+// The counts are kept in buckets of "Slide" positions, so a window is made of
+// "Size" / "Slide" buckets, and a reducer keeps at most "Size" / "Slide" +
+// "Retain" buckets for a word. Older buckets are expired.
+type Window struct {
+	Size   uint64
+	Slide  uint64
+	Time   bool
+	Retain uint
+}
+
+// TumblingWindow returns the Window of tumbling windows of "lines" lines.
+func TumblingWindow(lines uint) Window {
+	return Window{Size: uint64(lines)}
+}
+
+// SlidingWindow returns the Window of sliding windows of "lines" lines,
+// starting every "slide" lines.
+func SlidingWindow(lines, slide uint) Window {
+	return Window{Size: uint64(lines), Slide: uint64(slide)}
+}
+
+// TumblingTimeWindow returns the Window of tumbling windows of a duration.
+func TumblingTimeWindow(size time.Duration) Window {
+	return Window{Size: uint64(size), Time: true}
+}
+
+// SlidingTimeWindow returns the Window of sliding windows of a duration,
+// starting every "slide".
+func SlidingTimeWindow(size, slide time.Duration) Window {
+	return Window{Size: uint64(size), Slide: uint64(slide), Time: true}
+}
+
+// slide returns the length of a bucket, with the zero "Slide" replaced.
+func (w Window) slide() uint64 {
+	if w.Slide == 0 {
+		return w.Size
+	}
+	return w.Slide
+}
+
+// buckets returns the number of buckets in a window.
+func (w Window) buckets() uint64 {
+	return w.Size / w.slide()
+}
+
+// kept returns the number of buckets kept by a reducer for a word.
+func (w Window) kept() uint64 {
+	return w.buckets() + uint64(w.Retain)
+}
+
+// validate checks that "Size" is positive and a multiple of "Slide".
+func (w Window) validate() error {
+	if w.Size == 0 {
+		return fmt.Errorf("The window size must be positive")
+	}
+	if slide := w.slide(); slide > w.Size || w.Size%slide != 0 {
+		return fmt.Errorf("The window size must be a multiple of the slide: %d, %d", w.Size, slide)
+	}
+	return nil
+}
+
+// The windowedLine struct is the record of a Windowed network: a line and
+// the bucket of its position.
+type windowedLine struct {
+	bucket uint64
+	line   string
+}
+
+// The bucketCount struct is the value emitted by the mapper of a Windowed
+// network: a count of a word in a bucket.
+type bucketCount struct {
+	bucket uint64
+	count  uint
+}
+
+// countPerBucket returns the Reducer of a Windowed network. The accumulated
+// value of a word is its count in each bucket. When a count is added, the
+// buckets of the word older than the "kept" latest buckets are expired, and a
+// count of an expired bucket is dropped. The map is modified in place, so it
+// is only read by the reducer goroutine keeping it (see Windowed.lookup).
+func countPerBucket(kept uint64) Reducer[bucketCount, map[uint64]uint] {
+	return func(acc map[uint64]uint, value bucketCount) map[uint64]uint {
+		if acc == nil {
+			acc = make(map[uint64]uint)
+		}
+		latest := value.bucket
+		for bucket := range acc {
+			latest = max(latest, bucket)
+		}
+		oldest := latest + 1 - min(kept, latest+1)
+		for bucket := range acc {
+			if bucket < oldest {
+				delete(acc, bucket)
+			}
+		}
+		if value.bucket >= oldest {
+			acc[value.bucket] += value.count
+		}
+		return acc
+	}
+}
+
+// The Windowed struct is a running map-reduce network for counting words in
+// windows of an unbounded stream of lines, created by NewWindowed. Unlike
+// Network, which keeps the counts forever, it answers the counts in the
+// current window, or in a past window kept by "Retain" (see Window), and
+// expires the counts of the older windows. Its methods could be called by
+// many goroutines concurrently. It must not be used after Close is called.
+//
+// Like the queries of Network, the queries of Windowed wait until every line
+// passed to Map before the call has been counted.
+type Windowed struct {
+	n         *network[windowedLine, string, bucketCount, map[uint64]uint]
+	window    Window
+	now       func() time.Time
+	latest    atomic.Uint64
+	swept     atomic.Uint64
+	closeOnce sync.Once
+}
+
+// NewWindowed sets-up all the channels and goroutines of a map-reduce network
+// for counting words in the windows described by w. It accepts the same
+// options as NewNetwork, except WithCombiner, WithRemoteReducers and
+// WithApproximation.
+// If NewWindowed succeeds, it returns the Windowed network and a nil error;
+// Otherwise, it returns nil and a non-nil error.
+func NewWindowed(w Window, options ...Option) (*Windowed, error) {
+	if err := w.validate(); err != nil {
+		return nil, err
+	}
+	c := newConfig(options)
+	countWords := CountNGrams(c.tokenizer, c.ngrams)
+	mapper := func(lineNo uint, record windowedLine, emit func(string, bucketCount)) {
+		countWords(lineNo, record.line, func(word string, count uint) {
+			emit(word, bucketCount{record.bucket, count})
+		})
+	}
+	n, err := newNetwork(mapper, countPerBucket(w.kept()), c)
+	if err != nil {
+		return nil, err
+	}
+	return &Windowed{n: n, window: w, now: time.Now}, nil
+}
+
+// bucketOf returns the bucket of a line with the line number lineNo, and
+// marks it as the latest bucket if it is.
+func (wn *Windowed) bucketOf(lineNo uint) uint64 {
+	position := uint64(lineNo)
+	if wn.window.Time {
+		position = uint64(wn.now().UnixNano())
+	}
+	bucket := position / wn.window.slide()
+	for latest := wn.latest.Load(); bucket > latest; latest = wn.latest.Load() {
+		if wn.latest.CompareAndSwap(latest, bucket) {
+			break
+		}
+	}
+	return bucket
+}
+
+// current returns the bucket of the current position: the latest bucket of
+// the lines mapped, or the bucket of the current time if the windows are
+// measured in time.
+func (wn *Windowed) current() uint64 {
+	latest := wn.latest.Load()
+	if wn.window.Time {
+		latest = max(latest, uint64(wn.now().UnixNano())/wn.window.slide())
+	}
+	return latest
+}
+
+// Map sends a line to one of the mappers in a round-robin manner, where it
+// is split into words to be counted in the windows. "lineNo" is the line
+// number of the line, which is its position unless the windows are measured
+// in time.
+// Every time the "Retain" past windows have all slid by, Map expires the
+// counts of the words which do not appear since, so it then waits for the
+// lines passed before to be counted.
+func (wn *Windowed) Map(lineNo uint, line string) {
+	wn.MapContext(context.Background(), lineNo, line)
+}
+
+// MapContext is the same as Map, except that it returns the error of ctx if
+// ctx is done before a mapper receives the line. The line is then not counted.
+func (wn *Windowed) MapContext(ctx context.Context, lineNo uint, line string) error {
+	bucket := wn.bucketOf(lineNo)
+	if err := wn.n.mapContext(ctx, lineNo, windowedLine{bucket, line}); err != nil {
+		return err
+	}
+	if swept := wn.swept.Load(); bucket >= swept+wn.window.kept() && wn.swept.CompareAndSwap(swept, bucket) {
+		wn.expire(bucket)
+	}
+	return nil
+}
+
+// expire removes the buckets older than the kept buckets before "latest"
+// from every reducer, and the words which have no buckets left. The counts of
+// a word are otherwise only expired when it appears again.
+func (wn *Windowed) expire(latest uint64) {
+	oldest := latest + 1 - min(wn.window.kept(), latest+1)
+	wn.n.visitAll(func(dictionary map[string]map[uint64]uint) {
+		for word, perBucket := range dictionary {
+			for bucket := range perBucket {
+				if bucket < oldest {
+					delete(perBucket, bucket)
+				}
+			}
+			if len(perBucket) == 0 {
+				delete(dictionary, word)
+			}
+		}
+	}, nil)
+}
+
+// Bounds returns the positions [start, end) of the window "ago" slides before
+// the current window (0 for the current window). The positions are line
+// numbers, or nanoseconds since the Unix epoch if the windows are measured in
+// time.
+func (wn *Windowed) Bounds(ago uint) (uint64, uint64) {
+	first, last := wn.bucketRange(ago)
+	slide := wn.window.slide()
+	return first * slide, (last + 1) * slide
+}
+
+// bucketRange returns the first and the last buckets of the window "ago"
+// slides before the current window. The window is empty (first > last) if it
+// is before the first line.
+func (wn *Windowed) bucketRange(ago uint) (uint64, uint64) {
+	current := wn.current()
+	if uint64(ago) > current {
+		return 1, 0
+	}
+	last := current - uint64(ago)
+	return last + 1 - min(wn.window.buckets(), last+1), last
+}
+
+// lookup returns the sum of the counts of a word in the buckets [first,
+// last]. The dictionary of the reducer keeping the word is visited, instead of
+// queried, since the counts are only read by that reducer goroutine. The visit
+// is made once, so "total" is written by one goroutine only.
+func (wn *Windowed) lookup(word string, first, last uint64) uint {
+	total := uint(0)
+	wn.n.visitKey(word, func(dictionary map[string]map[uint64]uint) {
+		for bucket, count := range dictionary[word] {
+			if first <= bucket && bucket <= last {
+				total += count
+			}
+		}
+	})
+	return total
+}
+
+// Query returns the count of a word in the current window.
+func (wn *Windowed) Query(word string) uint {
+	count, _ := wn.QueryWindow(word, 0)
+	return count
+}
+
+// QueryWindow returns the count of a word in the window "ago" slides before
+// the current window. If the window is expired ("ago" is more than "Retain"),
+// it returns 0 and a non-nil error.
+func (wn *Windowed) QueryWindow(word string, ago uint) (uint, error) {
+	if ago > wn.window.Retain {
+		return 0, fmt.Errorf("The window %d slides ago is expired: only %d past windows are kept", ago, wn.window.Retain)
+	}
+	first, last := wn.bucketRange(ago)
+	return wn.lookup(word, first, last), nil
+}
+
+// QueryAll returns the counts of all words in the current window.
+func (wn *Windowed) QueryAll() map[string]uint {
+	first, last := wn.bucketRange(0)
+	var mutex sync.Mutex
+	dictionary := make(map[string]uint)
+	wn.n.visitAll(func(local map[string]map[uint64]uint) {
+		for word, perBucket := range local {
+			total := uint(0)
+			for bucket, count := range perBucket {
+				if first <= bucket && bucket <= last {
+					total += count
+				}
+			}
+			if total > 0 {
+				mutex.Lock()
+				dictionary[word] = total
+				mutex.Unlock()
+			}
+		}
+	}, nil)
+	return dictionary
+}
+
+// Err returns the first error reported by the stage goroutines, or nil if
+// there is none.
+func (wn *Windowed) Err() error {
+	return wn.n.errors.err()
+}
+
+// Close gracefully terminates the map-reduce network, after every line passed
+// to Map has been counted. Calling it more than once has no effect.
+func (wn *Windowed) Close() {
+	wn.closeOnce.Do(wn.n.shutdown)
+}
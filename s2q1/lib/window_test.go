@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+///////////
+// Tests //
+///////////
+
+// newWindowed returns NewWindowed with the window w, to be passed to
+// newTestStages.
+func newWindowed(w Window) func(...Option) (*Windowed, error) {
+	return func(options ...Option) (*Windowed, error) {
+		return NewWindowed(w, options...)
+	}
+}
+
+// TestTumblingWindow checks the counts of the current and the past tumbling
+// windows of 10 lines.
+func TestTumblingWindow(t *testing.T) {
+	w := TumblingWindow(10)
+	w.Retain = 2
+	windowed := newTestStages(t, newWindowed(w), 3, 1, 2)
+	defer windowed.Close()
+	// Line i has "TCP" once, and "w<i / 10>" once.
+	for lineNo := uint(0); lineNo < 35; lineNo++ {
+		windowed.Map(lineNo, fmt.Sprintf("TCP w%d", lineNo/10))
+	}
+
+	if got := windowed.Query("TCP"); got != 5 {
+		t.Errorf("Query(%q) = %d, expected 5", "TCP", got)
+	}
+	cases := []struct {
+		word     string
+		ago      uint
+		expected uint
+	}{
+		{"TCP", 1, 10},
+		{"w2", 1, 10},
+		{"w3", 1, 0},
+		{"w1", 2, 10},
+		{"w3", 0, 5},
+	}
+	for _, c := range cases {
+		if got, err := windowed.QueryWindow(c.word, c.ago); got != c.expected || err != nil {
+			t.Errorf("QueryWindow(%q, %d) = %d, %v, expected %d", c.word, c.ago, got, err, c.expected)
+		}
+	}
+	if _, err := windowed.QueryWindow("TCP", 3); err == nil {
+		t.Errorf("QueryWindow(%q, 3) returned a nil error", "TCP")
+	}
+	if start, end := windowed.Bounds(1); start != 20 || end != 30 {
+		t.Errorf("Bounds(1) = %d, %d, expected 20, 30", start, end)
+	}
+	if got := windowed.QueryAll(); len(got) != 2 || got["TCP"] != 5 || got["w3"] != 5 {
+		t.Errorf("QueryAll() = %v, expected TCP and w3 counted 5 times", got)
+	}
+	// Bucket 0 is expired by Map at line 30, and "w0" with it.
+	if got := windowed.n.distinctCount(); got != 4 {
+		t.Errorf("%d words are kept, expected 4", got)
+	}
+}
+
+// TestSlidingWindow checks the counts of sliding windows of 6 lines, starting
+// every 2 lines.
+func TestSlidingWindow(t *testing.T) {
+	w := SlidingWindow(6, 2)
+	w.Retain = 1
+	windowed := newTestStages(t, newWindowed(w), 2, 2, 3)
+	defer windowed.Close()
+	for lineNo := uint(0); lineNo < 9; lineNo++ {
+		line := "TCP"
+		if lineNo%3 == 0 {
+			line += " UDP"
+		}
+		windowed.Map(lineNo, line)
+	}
+
+	// The current window is [4, 10), the previous one is [2, 8).
+	if start, end := windowed.Bounds(0); start != 4 || end != 10 {
+		t.Errorf("Bounds(0) = %d, %d, expected 4, 10", start, end)
+	}
+	if got := windowed.Query("TCP"); got != 5 {
+		t.Errorf("Query(%q) = %d, expected 5", "TCP", got)
+	}
+	if got := windowed.Query("UDP"); got != 1 {
+		t.Errorf("Query(%q) = %d, expected 1", "UDP", got)
+	}
+	if got, _ := windowed.QueryWindow("UDP", 1); got != 2 {
+		t.Errorf("QueryWindow(%q, 1) = %d, expected 2", "UDP", got)
+	}
+
+	// A query is routed to the reducer keeping the word only.
+	before := windowed.n.stats().Routed
+	windowed.Query("TCP")
+	visited := 0
+	for i, routed := range windowed.n.stats().Routed {
+		if routed != before[i] {
+			visited++
+		}
+	}
+	if visited != 1 {
+		t.Errorf("Query(%q) is routed to %d reducers, expected 1", "TCP", visited)
+	}
+}
+
+// TestTimeWindow checks the counts of tumbling windows of a minute with a
+// fake clock.
+func TestTimeWindow(t *testing.T) {
+	clock := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	w := TumblingTimeWindow(time.Minute)
+	w.Retain = 1
+	windowed := newTestStages(t, newWindowed(w), 2, 1, 2)
+	defer windowed.Close()
+	windowed.now = func() time.Time { return clock }
+
+	windowed.Map(0, "TCP TCP")
+	clock = clock.Add(30 * time.Second)
+	windowed.Map(1, "TCP")
+	if got := windowed.Query("TCP"); got != 3 {
+		t.Errorf("Query(%q) = %d, expected 3", "TCP", got)
+	}
+	clock = clock.Add(time.Minute)
+	if got := windowed.Query("TCP"); got != 0 {
+		t.Errorf("Query(%q) = %d a minute later, expected 0", "TCP", got)
+	}
+	if got, _ := windowed.QueryWindow("TCP", 1); got != 3 {
+		t.Errorf("QueryWindow(%q, 1) = %d a minute later, expected 3", "TCP", got)
+	}
+	if start, _ := windowed.Bounds(0); start != uint64(clock.Truncate(time.Minute).UnixNano()) {
+		t.Errorf("Bounds(0) starts at %d, expected %v", start, clock.Truncate(time.Minute))
+	}
+}
+
+// TestNewWindowedErrors checks that NewWindowed() returns an error for invalid
+// windows.
+func TestNewWindowedErrors(t *testing.T) {
+	for _, w := range []Window{{}, SlidingWindow(10, 3), SlidingWindow(10, 20)} {
+		if _, err := NewWindowed(w); err == nil {
+			t.Errorf("NewWindowed(%+v) returned a nil error", w)
+		}
+	}
+}
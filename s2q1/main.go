@@ -3,48 +3,776 @@ package main
 import (
 	"./lib"
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"expvar"
+	"flag"
 	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 // "count" and "keywordToFind" are variables appear in the original Node.JS source.
+// "keywordToFind" is the keyword counted when no keyword option is given.
 var (
 	count         = uint(0)
 	keywordToFind = "TCP"
 )
 
+// The listFlag type is the value of an option which could be given more than
+// once, such as the keyword option.
+type listFlag []string
+
+func (f *listFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// The options, which are specified as flags before the other command line
+// arguments.
+var (
+	configFlag           = flag.String("config", "", "read the options from the JSON `file`, such as {\"input\": [\"input.txt\"], \"mappers\": 4} (the options on the command line take precedence)")
+	mappersFlag          = flag.Uint("mappers", uint(runtime.NumCPU()), "the number of mapper goroutines")
+	partitionersFlag     = flag.Uint("partitioners", uint(runtime.NumCPU()), "the number of partitioner goroutines (the number of CPUs by default, unlike the library)")
+	reducersFlag         = flag.Uint("reducers", uint(runtime.NumCPU()), "the number of reducer goroutines")
+	splitFlag            = flag.String("split", "words", "how lines are split into words: words, alphanumeric or runes")
+	foldCaseFlag         = flag.Bool("fold-case", false, "count words case-insensitively")
+	stripPunctuationFlag = flag.Bool("strip-punctuation", false, "remove leading and trailing punctuations from words")
+	stopWordsFlag        = flag.String("stop-words", "", "comma-separated list of words which are not counted")
+	stemFlag             = flag.Bool("stem", false, "count words by their stems (simple English stemming)")
+	ngramsFlag           = flag.String("ngrams", "1", "the numbers of words in the n-grams counted: `N` or MIN-MAX (1 for words only, 1-2 for words and bigrams)")
+	skipFlag             = flag.Uint("skip", 0, "the largest number of words skipped in an n-gram (skip-grams)")
+	bufferFlag           = flag.Uint("buffer", 0, "the capacity of the channels between the stages (0 for unbuffered)")
+	batchFlag            = flag.Uint("batch", 0, "send the words between the stages in batches of `N` (0 or 1 to send them one by one, 64 is a good start)")
+	batchLatencyFlag     = flag.Duration("batch-latency", 0, "send a batch which is not full after `duration` (0 to wait until it is full or the input ends)")
+	combineFlag          = flag.Uint("combine", 0, "combine the counts of every `N` lines in each mapper before sending them (0 to disable)")
+	partitionerFlag      = flag.String("partitioner", "fnv", "how words are sent to the reducers: fnv (hash modulo) or consistent (hash ring)")
+	memoryBudgetFlag     = flag.Uint64("memory-budget", 0, "spill the words of a reducer to temporary files when they take more than about `bytes` of memory (0 to keep them in memory)")
+	spillDirFlag         = flag.String("spill-dir", "", "the `directory` of the temporary files written by -memory-budget (the default directory for temporary files if empty)")
+	restoreFlag          = flag.String("restore", "", "add the counts in the snapshot `file` before counting the input")
+	snapshotFlag         = flag.String("snapshot", "", "write a snapshot of the counts to `file` after counting the input")
+	serveReducerFlag     = flag.String("serve-reducer", "", "run as a worker process keeping the counts of a reducer, listening on `address` (no other arguments are needed)")
+	remoteReducersFlag   = flag.String("remote-reducers", "", "comma-separated `addresses` of the worker processes keeping the counts (the reducer count is ignored)")
+	approximateFlag      = flag.Bool("approximate", false, "count words approximately with sketches in a fixed amount of memory (the words are not printed)")
+	epsilonFlag          = flag.Float64("epsilon", 0.0001, "the error of an approximate count, as a fraction of the total count")
+	deltaFlag            = flag.Float64("delta", 0.01, "the probability that an approximate count exceeds the error")
+	distinctErrorFlag    = flag.Float64("distinct-error", 0.01, "the relative standard error of the approximate number of distinct words")
+	documentsFlag        = flag.Bool("documents", false, "print the count and the TF-IDF score of the keyword in each input file to standard error")
+	watchFlag            = flag.Bool("watch", false, "print each change of the counts of the keywords to standard error while counting the input")
+	watchThresholdFlag   = flag.Uint("watch-threshold", 0, "with -watch, print only when a count reaches `N` (0 to print every change)")
+	distinctFlag         = flag.Bool("distinct", false, "print the number of distinct words to standard error")
+	windowFlag           = flag.String("window", "", "count words in windows of `size`, a number of lines or a duration such as 1m, and print the count of the keyword in each window")
+	slideFlag            = flag.String("slide", "", "start a window every `size` (a number of lines or a duration, the same as -window if empty)")
+	timeoutFlag          = flag.Duration("timeout", 0, "give up if counting the input and answering the queries take longer than `duration` (0 for no limit)")
+	metricsFlag          = flag.String("metrics", "", "serve the metrics on `address` while running, at /metrics (Prometheus text) and /debug/vars (expvar)")
+	serveFlag            = flag.String("serve", "", "after counting the input (which could be empty), keep serving the queries and accepting new lines as JSON over HTTP on `address`, until interrupted")
+	sortFlag             = flag.String("sort", "none", "the order of the words printed: none (any order), key or count (largest first, then by key)")
+	topFlag              = flag.Uint("top", 0, "print only the `N` words with the largest counts (0 for all words)")
+	formatFlag           = flag.String("format", "text", "the format of the output: text, json, csv or tsv")
+	labeledFlag          = flag.Bool("labeled", false, "label the count of each keyword in the text format, such as: count of \"TCP\": 14")
+	statsFlag            = flag.Bool("stats", false, "print the metrics as JSON to standard error after counting the input")
+	shutdownTimeoutFlag  = flag.Duration("shutdown-timeout", 0, "give up if terminating the goroutines takes longer than `duration` (0 for no limit)")
+)
+
+// keywordFlags are the values of the keyword option. If it is not given,
+// "keywordToFind" is counted.
+// inputFlags are the values of the input option, which are counted before the
+// inputs given as arguments.
+var (
+	keywordFlags listFlag
+	inputFlags   listFlag
+)
+
+func init() {
+	flag.Var(&inputFlags, "input", "count the `input` (a file, a directory, a glob pattern, or - for standard input), which could be given more than once")
+	flag.Var(&keywordFlags, "keyword", "count the `keyword` (a word, or a phrase when n-grams are counted), which could be given more than once (TCP if not given)")
+}
+
+// parseOutput checks the output options.
+// If parseOutput succeeds, it returns a nil error; Otherwise, it returns a
+// non-nil error.
+func parseOutput() error {
+	if !slices.Contains([]string{"none", "key", "count"}, *sortFlag) {
+		return fmt.Errorf("Unknown order: %s", *sortFlag)
+	}
+	if !slices.Contains([]string{"text", "json", "csv", "tsv"}, *formatFlag) {
+		return fmt.Errorf("Unknown output format: %s", *formatFlag)
+	}
+	return nil
+}
+
+// The keyword struct is a keyword to be counted: "text" is as it is given,
+// and "word" is normalized in the same way as the words counted.
+type keyword struct {
+	text string
+	word string
+}
+
+// parseKeywords normalizes the keywords given by the keyword option, or
+// "keywordToFind" if none is given, with the Tokenizer. A keyword could be a
+// phrase, such as "TCP three-way", when n-grams are counted.
+func parseKeywords(tokenizer lib.Tokenizer) []keyword {
+	texts := []string(keywordFlags)
+	if len(texts) == 0 {
+		texts = []string{keywordToFind}
+	}
+	keywords := make([]keyword, len(texts))
+	for i, text := range texts {
+		word, _ := tokenizer.NormalizeNGram(text)
+		keywords[i] = keyword{text, word}
+	}
+	return keywords
+}
+
+// parseTokenizer builds the Tokenizer from the tokenizer options.
+// If parseTokenizer succeeds, it returns the Tokenizer and a nil error;
+// Otherwise, it returns a zero Tokenizer and a non-nil error.
+func parseTokenizer() (lib.Tokenizer, error) {
+	var tokenizer lib.Tokenizer
+	switch *splitFlag {
+	case "words":
+		tokenizer.Split = bufio.ScanWords
+	case "alphanumeric":
+		tokenizer.Split = lib.ScanAlphanumeric
+	case "runes":
+		tokenizer.Split = bufio.ScanRunes
+	default:
+		return lib.Tokenizer{}, fmt.Errorf("Unknown split function: %s", *splitFlag)
+	}
+	tokenizer.FoldCase = *foldCaseFlag
+	tokenizer.StripPunctuation = *stripPunctuationFlag
+	if *stopWordsFlag != "" {
+		tokenizer.StopWords = make(map[string]bool)
+		for _, word := range strings.Split(*stopWordsFlag, ",") {
+			if *foldCaseFlag {
+				word = strings.ToLower(word)
+			}
+			tokenizer.StopWords[word] = true
+		}
+	}
+	if *stemFlag {
+		tokenizer.Stem = lib.StemEnglish
+	}
+	return tokenizer, nil
+}
+
+// parsePartitioner returns the Partitioner selected by the partitioner option.
+// If parsePartitioner succeeds, it returns the Partitioner and a nil error;
+// Otherwise, it returns nil and a non-nil error.
+func parsePartitioner() (lib.Partitioner, error) {
+	switch *partitionerFlag {
+	case "fnv":
+		return lib.FNVPartitioner{}, nil
+	case "consistent":
+		return lib.NewConsistentHashPartitioner(0), nil
+	}
+	return nil, fmt.Errorf("Unknown partitioner: %s", *partitionerFlag)
+}
+
+// parseNGrams builds the NGrams from the n-gram options. The sizes are given
+// as "N" or "MIN-MAX".
+// If parseNGrams succeeds, it returns the NGrams and a nil error;
+// Otherwise, it returns a zero NGrams and a non-nil error.
+func parseNGrams() (lib.NGrams, error) {
+	minSize, maxSize, found := strings.Cut(*ngramsFlag, "-")
+	if !found {
+		maxSize = minSize
+	}
+	sizes := make([]uint, 2)
+	for i, size := range []string{minSize, maxSize} {
+		n, err := strconv.ParseUint(size, 10, 0)
+		if err != nil || n == 0 {
+			return lib.NGrams{}, fmt.Errorf("Invalid n-gram sizes: %s", *ngramsFlag)
+		}
+		sizes[i] = uint(n)
+	}
+	return lib.NGrams{Min: sizes[0], Max: sizes[1], Skip: *skipFlag}, nil
+}
+
+// windowIncompatibleFlags are the options which could not be used with the
+// window option, since they need the totals of all lines.
+var windowIncompatibleFlags = []string{"approximate", "combine", "distinct", "documents", "memory-budget", "metrics", "remote-reducers", "restore", "serve", "snapshot", "stats", "watch"}
+
+// parseWindow builds the Window from the window options. The sizes are numbers
+// of lines, or durations if the window size is a duration. One past window is
+// kept, which is the window just completed when the time windows slide.
+// If parseWindow succeeds, it returns the Window and a nil error;
+// Otherwise, it returns a zero Window and a non-nil error.
+func parseWindow() (lib.Window, error) {
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if slices.Contains(windowIncompatibleFlags, f.Name) && err == nil {
+			err = fmt.Errorf("The option -%s could not be used with -window", f.Name)
+		}
+	})
+	if err != nil {
+		return lib.Window{}, err
+	}
+	size, slide := *windowFlag, *slideFlag
+	if slide == "" {
+		slide = size
+	}
+	var w lib.Window
+	if lines, err := strconv.ParseUint(size, 10, 0); err == nil {
+		slideLines, err := strconv.ParseUint(slide, 10, 0)
+		if err != nil {
+			return lib.Window{}, fmt.Errorf("Invalid slide: %s", slide)
+		}
+		w = lib.SlidingWindow(uint(lines), uint(slideLines))
+	} else {
+		sizeDuration, err := time.ParseDuration(size)
+		if err != nil {
+			return lib.Window{}, fmt.Errorf("Invalid window size: %s", size)
+		}
+		slideDuration, err := time.ParseDuration(slide)
+		if err != nil {
+			return lib.Window{}, fmt.Errorf("Invalid slide: %s", slide)
+		}
+		w = lib.SlidingTimeWindow(sizeDuration, slideDuration)
+	}
+	if w.Slide == 0 {
+		w.Slide = w.Size
+	}
+	w.Retain = 1
+	return w, nil
+}
+
+// restoreSnapshot adds the counts in the snapshot file at path to the network,
+// with the "restore" function.
+func restoreSnapshot(restore func(io.Reader) error, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return restore(file)
+}
+
+// saveSnapshot writes a snapshot of the network to the file at path, with the
+// "snapshot" function.
+func saveSnapshot(snapshot func(io.Writer) error, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := snapshot(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// serveReducer runs this process as a worker process keeping the counts of a
+// reducer, listening on address. It returns only if an error occurs.
+func serveReducer(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	fmt.Fprintf(os.Stderr, "serving reducer on %s\n", listener.Addr())
+	return lib.ServeReducer(listener)
+}
+
+// serveMetrics serves the metrics of the network on address, in the background.
+// It returns an error if address could not be listened on.
+func serveMetrics(network *lib.Network, address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	expvar.Publish("s2q1", network.ExpvarFunc())
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", network.MetricsHandler())
+	mux.Handle("/debug/vars", expvar.Handler())
+	fmt.Fprintf(os.Stderr, "serving metrics on %s\n", listener.Addr())
+	go http.Serve(listener, mux)
+	return nil
+}
+
+// serveQueries serves the queries of the network on listener, and accepts new
+// lines to be counted (see Network.QueryHandler), until the process is
+// interrupted. The requests in progress are then completed before it returns.
+// It returns an error if the server fails.
+func serveQueries(network *lib.Network, listener net.Listener) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := &http.Server{Handler: network.QueryHandler()}
+	errChannel := make(chan error, 1)
+	fmt.Fprintf(os.Stderr, "serving queries on %s\n", listener.Addr())
+	go func() {
+		errChannel <- server.Serve(listener)
+	}()
+	select {
+	case err := <-errChannel:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, shutdownCancel := contextWithTimeout(*shutdownTimeoutFlag)
+	defer shutdownCancel()
+	return server.Shutdown(shutdownCtx)
+}
+
+// contextWithTimeout returns a context which is done after timeout, or a
+// context which is never done if timeout is 0.
+func contextWithTimeout(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// exitOnError prints err to standard error and exits with status 2, if err is
+// not nil.
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+}
+
 // parseArgs parses the command line arguments.
+// The arguments are the inputs, optionally followed by the mapper count, the
+// partitioner count and the reducer count, which override the stage options,
+// as in "main input.txt 4 1 4". The last three arguments are taken as the
+// counts whenever they are all numbers, even if the inputs are given by the
+// input option only, as in "main -input input.txt 4 1 4". The inputs given by
+// the input option come first. At least one input must be given, unless the
+// queries are served.
 // The return values are:
-// (1) the path of "input.txt";
+// (1) the inputs;
 // (2) the mapper count;
 // (3) the partitioner count;
 // (4) the reducer count.
 // If parseArgs succeeds, it returns the above values and a nil error;
 // Otherwise, it return zero values for the above values and a non-nil error.
-func parseArgs() (string, uint, uint, uint, error) {
-	if len(os.Args) != 5 {
-		return "", 0, 0, 0, fmt.Errorf("Incorrect number of command line arguments")
+func parseArgs() ([]string, uint, uint, uint, error) {
+	args := flag.Args()
+	counts := []uint{*mappersFlag, *partitionersFlag, *reducersFlag}
+	if len(args) >= 3 {
+		positional := make([]uint, 3)
+		for i, arg := range args[len(args)-3:] {
+			n, err := strconv.ParseUint(arg, 10, 0)
+			if err != nil {
+				positional = nil
+				break
+			}
+			positional[i] = uint(n)
+		}
+		if positional != nil {
+			args, counts = args[:len(args)-3], positional
+		}
 	}
-	inputTxt := os.Args[1]
-	mapperCount, err := strconv.ParseUint(os.Args[2], 10, 0)
+	inputs := append(slices.Clone([]string(inputFlags)), args...)
+	if len(inputs) == 0 && *serveFlag == "" {
+		return nil, 0, 0, 0, fmt.Errorf("No input is given")
+	}
+	for i, name := range []string{"mapper", "partitioner", "reducer"} {
+		if counts[i] == 0 {
+			return nil, 0, 0, 0, fmt.Errorf("The %s count must be positive", name)
+		}
+	}
+	return inputs, counts[0], counts[1], counts[2], nil
+}
+
+// loadConfig sets the options from the JSON object in the file at path, unless
+// they are given on the command line. The keys of the object are the names of
+// the options, and the values are strings, numbers, booleans, or arrays of
+// them for the options which could be given more than once (input and
+// keyword). The relative paths of the inputs are relative to the directory of
+// the file, so that a file could be kept together with its inputs.
+func loadConfig(path string) error {
+	content, err := os.ReadFile(path)
 	if err != nil {
-		return "", 0, 0, 0, err
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	var settings map[string]any
+	if err := decoder.Decode(&settings); err != nil {
+		return fmt.Errorf("Invalid config file %s: %v", path, err)
+	}
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	for _, name := range slices.Sorted(maps.Keys(settings)) {
+		if name == "config" || name == "serve-reducer" || flag.Lookup(name) == nil {
+			return fmt.Errorf("Unknown option in config file %s: %s", path, name)
+		}
+		if given[name] {
+			continue
+		}
+		values, ok := settings[name].([]any)
+		if !ok {
+			values = []any{settings[name]}
+		}
+		for _, value := range values {
+			var text string
+			switch v := value.(type) {
+			case string:
+				text = v
+			case json.Number:
+				text = v.String()
+			case bool:
+				text = strconv.FormatBool(v)
+			default:
+				return fmt.Errorf("Invalid value of %s in config file %s: %v", name, path, value)
+			}
+			if name == "input" && text != "-" && !filepath.IsAbs(text) {
+				text = filepath.Join(filepath.Dir(path), text)
+			}
+			if err := flag.Set(name, text); err != nil {
+				return fmt.Errorf("Invalid value of %s in config file %s: %v", name, path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// expandInputs returns the paths of the files to be read for the inputs. An
+// input is one of:
+// (1) "-", which is standard input;
+// (2) a glob pattern (see filepath.Match), which is replaced by the paths
+//     matching it;
+// (3) a directory, which is replaced by the paths of all regular files in it
+//     and its subdirectories, in lexical order;
+// (4) the path of a file.
+// If expandInputs succeeds, it returns the paths and a nil error;
+// Otherwise (for example, if a pattern matches nothing), it returns nil and a
+// non-nil error.
+func expandInputs(inputs []string) ([]string, error) {
+	var paths []string
+	for _, input := range inputs {
+		if input == "-" {
+			paths = append(paths, input)
+			continue
+		}
+		matches := []string{input}
+		if strings.ContainsAny(input, "*?[") {
+			var err error
+			if matches, err = filepath.Glob(input); err != nil {
+				return nil, err
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("No files match %s", input)
+			}
+		}
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				paths = append(paths, match)
+				continue
+			}
+			err = filepath.WalkDir(match, func(path string, entry fs.DirEntry, err error) error {
+				if err == nil && entry.Type().IsRegular() {
+					paths = append(paths, path)
+				}
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return paths, nil
+}
+
+// The inputFile struct is an input opened by openInput. Reading it reads the
+// decompressed content if the file is compressed by gzip.
+type inputFile struct {
+	io.Reader
+	closers []io.Closer
+}
+
+// Close closes the decompressor and the file.
+func (f *inputFile) Close() error {
+	var err error
+	for _, closer := range f.closers {
+		if e := closer.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// openInput opens the file at path, or standard input if path is "-". A file
+// compressed by gzip is detected by its magic number, instead of its name, and
+// decompressed when it is read.
+func openInput(path string) (io.ReadCloser, error) {
+	f := &inputFile{}
+	var file io.Reader = os.Stdin
+	if path != "-" {
+		opened, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		file = opened
+		f.closers = append(f.closers, opened)
+	}
+	reader := bufio.NewReader(file)
+	f.Reader = reader
+	if magic, _ := reader.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		decompressor, err := gzip.NewReader(reader)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		f.Reader = decompressor
+		f.closers = append([]io.Closer{decompressor}, f.closers...)
 	}
-	partitionerCount, err := strconv.ParseUint(os.Args[3], 10, 0)
+	return f, nil
+}
+
+// mapInput calls mapLine with each line of the file at path, and its line
+// number in the file. It stops at the first error returned by mapLine.
+func mapInput(path string, mapLine func(lineNo uint, line string) error) error {
+	file, err := openInput(path)
 	if err != nil {
-		return "", 0, 0, 0, err
+		return err
 	}
-	reducerCount, err := strconv.ParseUint(os.Args[4], 10, 0)
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Split(bufio.ScanLines)
+	for lineNo := uint(0); scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		//fmt.Println(line)
+		if err := mapLine(lineNo, line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// runWindowed counts the words of the inputs in the windows described by w,
+// instead of in total, and prints the counts of the keywords in each window as
+// it is completed: after every "Slide" lines, or every "Slide" of time. The
+// windows are printed to standard error, unless the output format is text.
+// After all inputs are read, it prints the counts of the words in the current
+// window, and the counts of the keywords, in the same way as the totals. It
+// never keeps more than the counts of 2 windows, so the inputs could be an
+// unbounded stream, such as a log tailed from standard input.
+func runWindowed(ctx context.Context, w lib.Window, options []lib.Option, paths []string, keywords []keyword) error {
+	windowed, err := lib.NewWindowed(w, options...)
+	if err != nil {
+		return err
+	}
+	defer windowed.Close()
+
+	output := io.Writer(os.Stdout)
+	if *formatFlag != "text" {
+		output = os.Stderr
+	}
+	// printWindow prints the counts of the keywords in the window "ago"
+	// slides before the current window, separated by spaces.
+	printWindow := func(ago uint) {
+		start, end := windowed.Bounds(ago)
+		counts := make([]string, len(keywords))
+		for i, k := range keywords {
+			count, _ := windowed.QueryWindow(k.word, ago)
+			counts[i] = strconv.FormatUint(uint64(count), 10)
+		}
+		if w.Time {
+			fmt.Fprintf(output, "window %s - %s: %s\n", time.Unix(0, int64(start)).Format(time.TimeOnly), time.Unix(0, int64(end)).Format(time.TimeOnly), strings.Join(counts, " "))
+		} else {
+			fmt.Fprintf(output, "window %d - %d: %s\n", start, end-1, strings.Join(counts, " "))
+		}
+	}
+	if w.Time {
+		ticker := time.NewTicker(time.Duration(w.Slide))
+		done := make(chan bool)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ticker.C:
+					printWindow(1)
+				case <-done:
+					ticker.Stop()
+					return
+				}
+			}
+		}()
+		defer wg.Wait()
+		defer close(done)
+	}
+
+	lineNo := uint(0)
+	for _, path := range paths {
+		err := mapInput(path, func(_ uint, line string) error {
+			if err := windowed.MapContext(ctx, lineNo, line); err != nil {
+				return err
+			}
+			lineNo++
+			if !w.Time && uint64(lineNo)%w.Slide == 0 {
+				printWindow(0)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	counts := make([]uint, len(keywords))
+	for i, k := range keywords {
+		counts[i] = windowed.Query(k.word)
+	}
+	if err := printOutput(selectWords(windowed.QueryAll()), keywords, counts); err != nil {
+		return err
+	}
+	if err := windowed.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "some words are not counted: %v\n", err)
+	}
+	return nil
+}
+
+// printDocuments prints the count of each keyword in each document, its
+// document frequency, and the documents ranked by its TF-IDF score, to
+// standard error.
+func printDocuments(corpus *lib.Corpus, keywords []keyword) {
+	documents := corpus.Documents()
+	fmt.Fprintf(os.Stderr, "documents: %d\n", len(documents))
+	for _, k := range keywords {
+		fmt.Fprintf(os.Stderr, "document frequency of %q: %d\n", k.word, corpus.DocumentFrequency(k.word))
+		for _, ds := range corpus.TFIDF(k.word, uint(len(documents))) {
+			fmt.Fprintf(os.Stderr, "%s: count %d, tf-idf %.6f\n", documents[ds.Document], ds.Count, ds.Score)
+		}
+	}
+}
+
+// watchKeywords prints each change of the counts of the keywords (or only
+// when a count reaches the threshold of the watch-threshold option) to
+// standard error, until the returned function is called. The function waits
+// until the updates received are all printed.
+func watchKeywords(network *lib.Network, keywords []keyword) (func(), error) {
+	w := lib.Watch{Threshold: *watchThresholdFlag}
+	for _, k := range keywords {
+		w.Words = append(w.Words, k.word)
+	}
+	updates := make(chan lib.WordCount, 1024)
+	cancel, err := network.Watch(w, updates)
 	if err != nil {
-		return "", 0, 0, 0, err
+		return nil, err
 	}
-	return inputTxt, uint(mapperCount), uint(partitionerCount), uint(reducerCount), nil
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for wc := range updates {
+			fmt.Fprintf(os.Stderr, "update of %q: %d\n", wc.Word, wc.Count)
+		}
+	}()
+	return func() {
+		cancel()
+		close(updates)
+		wg.Wait()
+	}, nil
+}
+
+// selectWords returns the words of a dictionary and their counts to be
+// printed, in the order of the sort option, and only the largest ones if the
+// top option is given. Without both options, the order is the order of a
+// range over the dictionary, which changes every time.
+func selectWords(dictionary map[string]uint) []lib.WordCount {
+	if *sortFlag == "none" && *topFlag == 0 {
+		wcs := make([]lib.WordCount, 0, len(dictionary))
+		for word, count := range dictionary {
+			wcs = append(wcs, lib.WordCount{Word: word, Count: count})
+		}
+		return wcs
+	}
+	return lib.SortWordCounts(dictionary, *sortFlag != "key", *topFlag)
+}
+
+// printOutput prints the words and their counts, followed by the counts of
+// the keywords, to standard output in the format of the format option:
+// (1) "text" prints a word and its count separated by a space on each line,
+//     then the count of each keyword on its own line, which is labeled if the
+//     labeled option is given;
+// (2) "json" prints an object, with the words and the keywords as arrays of
+//     {"word": ..., "count": ...};
+// (3) "csv" and "tsv" print a row of "kind", "word" and "count" for each word
+//     and each keyword, after a header row, where "kind" is "word" or
+//     "keyword".
+func printOutput(words []lib.WordCount, keywords []keyword, counts []uint) error {
+	keywordCounts := make([]lib.WordCount, len(keywords))
+	for i, k := range keywords {
+		keywordCounts[i] = lib.WordCount{Word: k.text, Count: counts[i]}
+	}
+	switch *formatFlag {
+	case "json":
+		if words == nil {
+			words = []lib.WordCount{}
+		}
+		return json.NewEncoder(os.Stdout).Encode(struct {
+			Words    []lib.WordCount `json:"words"`
+			Keywords []lib.WordCount `json:"keywords"`
+		}{words, keywordCounts})
+	case "csv", "tsv":
+		w := csv.NewWriter(os.Stdout)
+		if *formatFlag == "tsv" {
+			w.Comma = '\t'
+		}
+		w.Write([]string{"kind", "word", "count"})
+		for _, wc := range words {
+			w.Write([]string{"word", wc.Word, strconv.FormatUint(uint64(wc.Count), 10)})
+		}
+		for _, wc := range keywordCounts {
+			w.Write([]string{"keyword", wc.Word, strconv.FormatUint(uint64(wc.Count), 10)})
+		}
+		w.Flush()
+		return w.Error()
+	}
+	for _, wc := range words {
+		fmt.Println(wc.Word, wc.Count)
+	}
+	// The global variable "count"
+	for _, wc := range keywordCounts {
+		if *labeledFlag {
+			fmt.Printf("count of %q: %d\n", wc.Word, wc.Count)
+			continue
+		}
+		count = wc.Count
+		printResult()
+	}
+	return nil
 }
 
 // printUsage prints a usage reminder for this command to standard error.
 func printUsage() {
-	fmt.Fprintf(os.Stderr, "Usage: %s <input-file> <mapper-count> <partitioner-count> <reducer-count>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] <input>... [<mapper-count> <partitioner-count> <reducer-count>]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s -config <file> [options] [<input>...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s -serve <address> [options] [<input>...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Options:\n")
+	flag.PrintDefaults()
 }
 
 // printResult prints the global variable "count" to standard output.
@@ -54,40 +782,209 @@ func printResult() {
 }
 
 func main() {
-	inputTxt, mapperCount, partitionerCount, reducerCount, err := parseArgs()
+	flag.Usage = printUsage
+	flag.Parse()
+	if *serveReducerFlag != "" {
+		if err := serveReducer(*serveReducerFlag); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		return
+	}
+	if *configFlag != "" {
+		if err := loadConfig(*configFlag); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+			return
+		}
+	}
+	inputs, mapperCount, partitionerCount, reducerCount, err := parseArgs()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		printUsage()
+		os.Exit(1)
+		return
+	}
+	tokenizer, err := parseTokenizer()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		printUsage()
+		os.Exit(1)
+		return
+	}
+	partitioner, err := parsePartitioner()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		printUsage()
+		os.Exit(1)
+		return
+	}
+	ngrams, err := parseNGrams()
 	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		printUsage()
+		os.Exit(1)
+		return
+	}
+	if err := parseOutput(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		printUsage()
 		os.Exit(1)
 		return
 	}
 
-	file, err := os.Open(inputTxt)
+	paths, err := expandInputs(inputs)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "file not found\n")
+		fmt.Fprintf(os.Stderr, "file not found: %v\n", err)
 		os.Exit(2)
 		return
 	}
-	defer file.Close()
 
-	// Since "map" is a keyword in Go, "mapFunc" is used in the following line
-	mapFunc, query, queryAll, shutdown := lib.Setup(mapperCount, partitionerCount, reducerCount)
-	defer shutdown()
+	options := []lib.Option{
+		lib.WithMappers(mapperCount),
+		lib.WithPartitioners(partitionerCount),
+		lib.WithReducers(reducerCount),
+		lib.WithBufferSize(*bufferFlag),
+		lib.WithTokenizer(tokenizer),
+		lib.WithNGrams(ngrams),
+		lib.WithPartitioner(partitioner),
+	}
+	if *batchFlag > 1 {
+		options = append(options, lib.WithBatching(*batchFlag, *batchLatencyFlag))
+	}
+	if *combineFlag > 0 {
+		options = append(options, lib.WithCombiner(lib.Sum[uint], *combineFlag))
+	}
+	if *remoteReducersFlag != "" {
+		options = append(options, lib.WithRemoteReducers(strings.Split(*remoteReducersFlag, ",")...))
+	}
+	if *approximateFlag {
+		options = append(options, lib.WithApproximation(*epsilonFlag, *deltaFlag, *distinctErrorFlag))
+	}
+	if *memoryBudgetFlag > 0 {
+		options = append(options, lib.WithSpill(*memoryBudgetFlag, *spillDirFlag))
+	}
+	keywords := parseKeywords(tokenizer)
+
+	if *windowFlag != "" {
+		w, err := parseWindow()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			printUsage()
+			os.Exit(1)
+			return
+		}
+		ctx, cancel := contextWithTimeout(*timeoutFlag)
+		defer cancel()
+		exitOnError(runWindowed(ctx, w, options, paths, keywords))
+		return
+	}
 
-	scanner := bufio.NewScanner(file)
-	scanner.Split(bufio.ScanLines)
-	for lineNo := uint(0); scanner.Scan(); lineNo++ {
-		line := scanner.Text()
-		//fmt.Println(line)
-		mapFunc(lineNo, line)
+	network, err := lib.NewNetwork(options...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		printUsage()
+		os.Exit(1)
+		return
+	}
+	if *metricsFlag != "" {
+		exitOnError(serveMetrics(network, *metricsFlag))
+	}
+	// The address is listened on before the input is counted, so that a bad
+	// address is reported at once.
+	var queryListener net.Listener
+	if *serveFlag != "" {
+		queryListener, err = net.Listen("tcp", *serveFlag)
+		exitOnError(err)
+	}
+
+	ctx, cancel := contextWithTimeout(*timeoutFlag)
+	defer cancel()
+
+	if *restoreFlag != "" {
+		if err := restoreSnapshot(network.Restore, *restoreFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot restore snapshot: %v\n", err)
+			os.Exit(2)
+			return
+		}
+	}
+
+	// The updates are printed by their own goroutine, so that the reducers do
+	// not wait for the main goroutine, which maps the lines.
+	stopWatch := func() {}
+	if *watchFlag {
+		stopWatch, err = watchKeywords(network, keywords)
+		exitOnError(err)
+	}
+
+	// The corpus keeps the counts of each input file, only if they are
+	// printed, since it counts every word again.
+	var corpus *lib.Corpus
+	if *documentsFlag {
+		corpus, err = lib.NewCorpus(options...)
+		exitOnError(err)
+		defer corpus.Close()
+	}
+	lineNo := uint(0)
+	for _, path := range paths {
+		var document uint
+		if corpus != nil {
+			document = corpus.AddDocument(path)
+		}
+		err := mapInput(path, func(documentLineNo uint, line string) error {
+			if err := network.MapContext(ctx, lineNo, line); err != nil {
+				return err
+			}
+			lineNo++
+			if corpus != nil {
+				return corpus.MapContext(ctx, document, documentLineNo, line)
+			}
+			return nil
+		})
+		exitOnError(err)
+	}
+
+	if *snapshotFlag != "" {
+		if err := saveSnapshot(network.Snapshot, *snapshotFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot save snapshot: %v\n", err)
+			os.Exit(2)
+			return
+		}
 	}
 
 	// OUTPUT ALL KEYS AND THEIR FINAL COUNT
-	dictionary := queryAll()
-	for word, count := range dictionary {
-		fmt.Println(word, count)
+	dictionary, err := network.QueryAllContext(ctx)
+	exitOnError(err)
+	counts := make([]uint, len(keywords))
+	for i, k := range keywords {
+		counts[i], err = network.QueryContext(ctx, k.word)
+		exitOnError(err)
 	}
+	stopWatch()
+	exitOnError(printOutput(selectWords(dictionary), keywords, counts))
 
-	// The global variable "count"
-	count = query(keywordToFind)
-	printResult()
+	if corpus != nil {
+		printDocuments(corpus, keywords)
+	}
+	if *distinctFlag {
+		fmt.Fprintf(os.Stderr, "distinct words: %d\n", network.DistinctCount())
+	}
+	if *statsFlag {
+		fmt.Fprintln(os.Stderr, network.ExpvarFunc().String())
+	}
+
+	// The lines which could not be counted are reported, but do not stop the
+	// other lines from being counted.
+	if err := network.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "some words are not counted: %v\n", err)
+	}
+
+	if queryListener != nil {
+		exitOnError(serveQueries(network, queryListener))
+	}
+
+	// A stage which fails to drain is reported, instead of hanging forever.
+	shutdownCtx, shutdownCancel := contextWithTimeout(*shutdownTimeoutFlag)
+	defer shutdownCancel()
+	exitOnError(network.CloseContext(shutdownCtx))
 }